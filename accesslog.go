@@ -0,0 +1,342 @@
+package main
+
+// access log and audit log.
+// auth: github.com/liikii
+
+import "bufio"
+import "encoding/json"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "os"
+import "strconv"
+import "sync"
+import "time"
+
+
+const (
+    logFormatCommon   = "common"
+    logFormatCombined = "combined"
+    logFormatJSON     = "json"
+)
+
+// audit actions.
+const (
+    auditUpload = "upload"
+    auditDelete = "delete"
+    auditRename = "rename"
+    auditShare  = "share"
+    auditFetch  = "fetch"
+)
+
+
+var accessLog io.Writer = os.Stdout
+var accessLogFormat string = logFormatCombined
+var auditLogW io.Writer
+
+
+// rotateWriter is an append only log file, rotated by size.
+// path -> path.1 -> path.2 ... path.backups
+type rotateWriter struct {
+    mu      sync.Mutex
+    path    string
+    maxSize int64
+    backups int
+    f       *os.File
+    size    int64
+}
+
+
+func newRotateWriter(path string, maxSize int64, backups int) (*rotateWriter, error) {
+    rw := &rotateWriter{path: path, maxSize: maxSize, backups: backups}
+    if err := rw.open(); err != nil {
+        return nil, err
+    }
+    return rw, nil
+}
+
+
+func (rw *rotateWriter) open() error {
+    f, err := os.OpenFile(rw.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+    if err != nil {
+        return err
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    rw.f = f
+    rw.size = fi.Size()
+    return nil
+}
+
+
+func (rw *rotateWriter) rotate() error {
+    rw.f.Close()
+    for i := rw.backups - 1; i > 0; i-- {
+        os.Rename(rw.path+"."+strconv.Itoa(i), rw.path+"."+strconv.Itoa(i+1))
+    }
+    if rw.backups > 0 {
+        os.Rename(rw.path, rw.path+".1")
+    } else {
+        os.Remove(rw.path)
+    }
+    return rw.open()
+}
+
+
+func (rw *rotateWriter) Write(p []byte) (int, error) {
+    rw.mu.Lock()
+    defer rw.mu.Unlock()
+    if rw.maxSize > 0 && rw.size > 0 && rw.size+int64(len(p)) > rw.maxSize {
+        if err := rw.rotate(); err != nil {
+            return 0, err
+        }
+    }
+    n, err := rw.f.Write(p)
+    rw.size += int64(n)
+    return n, err
+}
+
+
+// open_log_writer: "-" is stdout, "" is disabled (nil).
+func open_log_writer(path string, maxMB int64, backups int) (io.Writer, error) {
+    switch path {
+    case "":
+        return nil, nil
+    case "-":
+        return os.Stdout, nil
+    }
+    return newRotateWriter(path, maxMB<<20, backups)
+}
+
+
+// logResponseWriter records status and body size of a response.
+type logResponseWriter struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+
+func (lw *logResponseWriter) WriteHeader(code int) {
+    if lw.status == 0 {
+        lw.status = code
+    }
+    lw.ResponseWriter.WriteHeader(code)
+}
+
+
+func (lw *logResponseWriter) Write(b []byte) (int, error) {
+    if lw.status == 0 {
+        lw.status = 200
+    }
+    n, err := lw.ResponseWriter.Write(b)
+    lw.bytes += int64(n)
+    return n, err
+}
+
+
+// ReadFrom keeps the sendfile path of the underlying writer.
+func (lw *logResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+    if lw.status == 0 {
+        lw.status = 200
+    }
+    var n int64
+    var err error
+    if rf, ok := lw.ResponseWriter.(io.ReaderFrom); ok {
+        n, err = rf.ReadFrom(src)
+    } else {
+        n, err = io.Copy(lw.ResponseWriter, src)
+    }
+    lw.bytes += n
+    return n, err
+}
+
+
+func (lw *logResponseWriter) Flush() {
+    if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+
+func (lw *logResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    hj, ok := lw.ResponseWriter.(http.Hijacker)
+    if !ok {
+        return nil, nil, fmt.Errorf("webserver doesn't support hijacking")
+    }
+    if lw.status == 0 {
+        lw.status = 500
+    }
+    return hj.Hijack()
+}
+
+
+func (lw *logResponseWriter) Unwrap() http.ResponseWriter {
+    return lw.ResponseWriter
+}
+
+
+type countReader struct {
+    io.ReadCloser
+    n int64
+}
+
+
+func (cr *countReader) Read(p []byte) (int, error) {
+    n, err := cr.ReadCloser.Read(p)
+    cr.n += int64(n)
+    return n, err
+}
+
+
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+
+// claimedUser is the basic auth user name the client sent, "-" when
+// none. no password is checked: it is a claim, not who the client is.
+func claimedUser(r *http.Request) string {
+    if u, _, ok := r.BasicAuth(); ok && u != "" {
+        return u
+    }
+    return "-"
+}
+
+
+type accessEntry struct {
+    Time        string  `json:"time"`
+    Remote      string  `json:"remote"`
+    ClaimedUser string  `json:"claimed_user"`
+    Method      string  `json:"method"`
+    URI         string  `json:"uri"`
+    Proto       string  `json:"proto"`
+    Status      int     `json:"status"`
+    Bytes       int64   `json:"bytes"`
+    BytesIn     int64   `json:"bytes_in"`
+    Duration    float64 `json:"duration_ms"`
+    Referer     string  `json:"referer"`
+    UserAgent   string  `json:"user_agent"`
+    RequestID   string  `json:"request_id"`
+}
+
+
+func dashIfEmpty(s string) string {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
+
+
+func write_access_log(r *http.Request, lw *logResponseWriter, bytesIn int64, start time.Time) {
+    if accessLog == nil {
+        return
+    }
+    status := lw.status
+    if status == 0 {
+        status = 200
+    }
+    if accessLogFormat == logFormatJSON {
+        b, err := json.Marshal(accessEntry{
+            Time:        start.Format(time.RFC3339),
+            Remote:      clientIP(r),
+            ClaimedUser: claimedUser(r),
+            Method:      r.Method,
+            URI:         r.RequestURI,
+            Proto:       r.Proto,
+            Status:      status,
+            Bytes:       lw.bytes,
+            BytesIn:     bytesIn,
+            Duration:    float64(time.Since(start).Microseconds()) / 1000,
+            Referer:     r.Referer(),
+            UserAgent:   r.UserAgent(),
+            RequestID:   requestID(r),
+        })
+        if err != nil {
+            return
+        }
+        accessLog.Write(append(b, '\n'))
+        return
+    }
+
+    size := "-"
+    if lw.bytes > 0 {
+        size = strconv.FormatInt(lw.bytes, 10)
+    }
+    line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+        clientIP(r), claimedUser(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+        r.Method, r.RequestURI, r.Proto, status, size)
+    if accessLogFormat == logFormatCombined {
+        line += fmt.Sprintf(" %q %q", dashIfEmpty(r.Referer()), dashIfEmpty(r.UserAgent()))
+    }
+    io.WriteString(accessLog, line+"\n")
+}
+
+
+// logRequests is the access log middleware.
+func logRequests(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        r = withRequestID(r)
+        w.Header().Set("X-Request-Id", requestID(r))
+        lw := &logResponseWriter{ResponseWriter: w}
+        var cr *countReader
+        if r.Body != nil {
+            cr = &countReader{ReadCloser: r.Body}
+            r.Body = cr
+        }
+        h.ServeHTTP(lw, r)
+        var bytesIn int64
+        if cr != nil {
+            bytesIn = cr.n
+        }
+        write_access_log(r, lw, bytesIn, start)
+    })
+}
+
+
+type auditEvent struct {
+    Time        string `json:"time"`
+    Action      string `json:"action"`
+    ClaimedUser string `json:"claimed_user"`
+    Remote      string `json:"remote"`
+    Path        string `json:"path"`
+    Target      string `json:"target,omitempty"`
+    Size        int64  `json:"size,omitempty"`
+    Detail      string `json:"detail,omitempty"`
+    RequestID   string `json:"request_id,omitempty"`
+}
+
+
+// audit records who did what from which address.
+func audit(r *http.Request, ev auditEvent) {
+    ev.ClaimedUser = claimedUser(r)
+    ev.Remote = clientIP(r)
+    ev.RequestID = requestID(r)
+    write_audit(ev)
+}
+
+
+// write_audit records ev as it is, for work outliving its request.
+func write_audit(ev auditEvent) {
+    if auditLogW == nil {
+        return
+    }
+    ev.Time = time.Now().Format(time.RFC3339)
+    b, err := json.Marshal(ev)
+    if err != nil {
+        log.Printf("audit: %v", err)
+        return
+    }
+    auditLogW.Write(append(b, '\n'))
+}
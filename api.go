@@ -0,0 +1,808 @@
+package main
+
+// json api: /_/api/v1/..., described by /_/api/v1/openapi.json.
+// auth: github.com/liikii
+
+import "bufio"
+import "crypto/rand"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/fs"
+import "log"
+import "mime"
+import "net/http"
+import "net/textproto"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+
+
+// the endpoints of trans are below reservedPrefix, besides /s/ and
+// /upload of old, so they don't hide shared files of the same names. a
+// folder "_" at the top of the share is out of reach.
+const reservedPrefix = "/_"
+const apiPrefix = reservedPrefix + "/api/v1"
+
+const apiDefaultLimit = 100
+const apiMaxLimit = 1000
+
+// folders an uploaded path may go down.
+const maxUploadDepth = 64
+
+// -apiwrite: who may delete, move and manage share links.
+const (
+    apiWriteNone  = "none"
+    apiWriteAdmin = "admin"
+    apiWriteAll   = "all"
+)
+
+var apiWrite = apiWriteAdmin
+
+
+// statInfo is the answer of /_/api/v1/stat. Free is the free space of the
+// file system holding the path, 0 when unknown.
+type statInfo struct {
+    Path     string     `json:"path"`
+    Exists   bool       `json:"exists"`
+    Type     string     `json:"type,omitempty"` // file or dir
+    Size     int64      `json:"size"`
+    ModTime  *time.Time `json:"mtime,omitempty"`
+    Writable bool       `json:"writable"`
+    Free     uint64     `json:"free"`
+}
+
+
+// apiEntry is one entry of a directory listing.
+type apiEntry struct {
+    Name    string    `json:"name"`
+    Path    string    `json:"path"`
+    Type    string    `json:"type"` // file or dir
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mtime"`
+    Link    string    `json:"link,omitempty"` // symlink target
+    SHA256  string    `json:"sha256,omitempty"` // files, with hash=sha256
+}
+
+
+// page of a paginated answer, Next is the offset of the next page,
+// absent on the last one.
+type apiPage struct {
+    Offset int  `json:"offset"`
+    Limit  int  `json:"limit"`
+    Next   *int `json:"next,omitempty"`
+}
+
+
+type listResult struct {
+    Path    string     `json:"path"`
+    Total   int        `json:"total"`
+    Entries []apiEntry `json:"entries"`
+    apiPage
+}
+
+
+type searchResults struct {
+    Query   string         `json:"query"`
+    Mode    string         `json:"mode"`
+    Path    string         `json:"path"`
+    Results []searchResult `json:"results"`
+    apiPage
+}
+
+
+// uploadResult: Skipped are the hidden paths of a folder upload, they
+// are left out, not failed. Archives are those unpacked, ?extract=1.
+type uploadResult struct {
+    Files    []statInfo       `json:"files"`
+    Skipped  []string         `json:"skipped,omitempty"`
+    Archives []*archiveResult `json:"archives,omitempty"`
+}
+
+
+type moveRequest struct {
+    From      string `json:"from"`
+    To        string `json:"to"`
+    Overwrite bool   `json:"overwrite"`
+}
+
+
+type mkdirRequest struct {
+    Path    string `json:"path"`
+    Parents bool   `json:"parents"` // like mkdir -p
+}
+
+
+// apiPath cleans the path parameter into a url path, "/" first.
+func apiPath(p string) (string, error) {
+    if containsDotDot(p) {
+        return "", errInvalidPath
+    }
+    return path.Clean("/" + p), nil
+}
+
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+
+// readJSON decodes a small json body into v.
+func readJSON(r *http.Request, v interface{}) error {
+    if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+        return errors.New("want an application/json body")
+    }
+    dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+    dec.DisallowUnknownFields()
+    return dec.Decode(v)
+}
+
+
+// pageParams reads offset and limit.
+func pageParams(r *http.Request) (apiPage, error) {
+    p := apiPage{Limit: apiDefaultLimit}
+    q := r.URL.Query()
+    if s := q.Get("offset"); s != "" {
+        n, err := strconv.Atoi(s)
+        if err != nil || n < 0 {
+            return p, errors.New("bad offset")
+        }
+        p.Offset = n
+    }
+    if s := q.Get("limit"); s != "" {
+        n, err := strconv.Atoi(s)
+        if err != nil || n <= 0 {
+            return p, errors.New("bad limit")
+        }
+        p.Limit = n
+    }
+    if p.Limit > apiMaxLimit {
+        p.Limit = apiMaxLimit
+    }
+    return p, nil
+}
+
+
+// cut returns the [lo, hi) bounds of the page in n items and sets Next.
+func (p *apiPage) cut(n int) (lo, hi int) {
+    lo, hi = p.Offset, p.Offset+p.Limit
+    if lo > n {
+        lo = n
+    }
+    if hi >= n {
+        hi = n
+    } else {
+        next := hi
+        p.Next = &next
+    }
+    return lo, hi
+}
+
+
+func boolParam(r *http.Request, name string) bool {
+    v, _ := strconv.ParseBool(r.URL.Query().Get(name))
+    return v
+}
+
+
+// apiWriteAllowed guards deletes, moves and share links.
+func apiWriteAllowed(w http.ResponseWriter, r *http.Request) bool {
+    switch {
+    case apiWrite == apiWriteAll:
+        return true
+    case apiWrite == apiWriteAdmin && adminAuthorized(r):
+        return true
+    }
+    serveError(w, r, 403, "not allowed, see -apiwrite")
+    return false
+}
+
+
+// apiFail serves err, mapping the errors of file operations.
+func apiFail(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case errors.Is(err, errUploadCanceled):
+        serveError(w, r, 400, "upload canceled")
+    case errors.Is(err, fs.ErrExist), errors.Is(err, syscall.ENOTEMPTY), errors.Is(err, syscall.EEXIST):
+        serveError(w, r, 409, err.Error())
+    case errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EISDIR):
+        serveError(w, r, 409, err.Error())
+    default:
+        httpError(w, r, err)
+    }
+}
+
+
+func parse_api_write(s string) error {
+    switch s {
+    case apiWriteNone, apiWriteAdmin, apiWriteAll:
+        apiWrite = s
+        return nil
+    }
+    return fmt.Errorf("unknown mode %q, want none, admin or all", s)
+}
+
+
+// lookup opens upath under the symlink policy and stats it. hidden paths
+// don't exist.
+func lookup(upath string) (fs.FileInfo, error) {
+    rel := strings.TrimPrefix(upath, "/")
+    f, err := open_in_root(dst, rel)
+    if err != nil {
+        return nil, err
+    }
+    fi, err := f.Stat()
+    f.Close()
+    if err != nil {
+        return nil, err
+    }
+    if !newHideChecker().fetchable(rel, fi.IsDir()) {
+        return nil, fs.ErrNotExist
+    }
+    return fi, nil
+}
+
+
+// stat_path describes upath, hidden paths and paths the symlink policy
+// refuses don't exist.
+func stat_path(upath string) statInfo {
+    st := statInfo{Path: upath}
+    fi, err := lookup(upath)
+    if err != nil {
+        return st
+    }
+    p := filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(upath, "/")))
+    st.Exists = true
+    st.Type = "file"
+    if fi.IsDir() {
+        st.Type = "dir"
+    }
+    st.Size = fi.Size()
+    mtime := fi.ModTime()
+    st.ModTime = &mtime
+    st.Writable = dirWritable(p)
+    dir := p
+    if !fi.IsDir() {
+        dir = filepath.Dir(p)
+    }
+    if _, free, ok := diskUsage(dir); ok {
+        st.Free = free
+    }
+    return st
+}
+
+
+// writeTarget checks upath can be created: its directory exists and the
+// name is not hidden. isDir is what will be created.
+func writeTarget(upath string, isDir bool) error {
+    rel := strings.TrimPrefix(upath, "/")
+    if rel == "" {
+        return errInvalidPath
+    }
+    if newHideChecker().hidden(rel, isDir) {
+        return linkError(upath)
+    }
+    if !dir_in_root(path.Dir(rel)) {
+        return fs.ErrNotExist
+    }
+    return nil
+}
+
+
+// save_file writes body to upath through a temporary file renamed in
+// place, a failed upload leaves nothing behind.
+func save_file(r *http.Request, upath string, body io.Reader, overwrite bool) (int64, error) {
+    n, err := write_file(upath, body, overwrite)
+    if err != nil {
+        return n, err
+    }
+    set_mtime(r, strings.TrimPrefix(upath, "/"))
+    audit(r, auditEvent{Action: auditUpload, Path: upath, Size: n})
+    return n, nil
+}
+
+
+// write_file is save_file without a request to take the mtime from and
+// to audit.
+func write_file(upath string, body io.Reader, overwrite bool) (int64, error) {
+    rel := strings.TrimPrefix(upath, "/")
+    if err := writeTarget(upath, false); err != nil {
+        return 0, err
+    }
+    if mode, err := lstat_in_root(rel); err == nil {
+        if mode.IsDir() {
+            return 0, &fs.PathError{Op: "create", Path: upath, Err: syscall.EISDIR}
+        }
+        if !overwrite {
+            return 0, &fs.PathError{Op: "create", Path: upath, Err: fs.ErrExist}
+        }
+    }
+    var rnd [8]byte
+    rand.Read(rnd[:])
+    tmp := path.Join(path.Dir(rel), tempPrefix+"upload-"+hex.EncodeToString(rnd[:]))
+    f, err := create_in_root(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+    if err != nil {
+        mUploadFailures.Inc("create")
+        return 0, err
+    }
+    n, err := io.Copy(f, body)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = rename_in_root(tmp, rel)
+    }
+    if err != nil {
+        mUploadFailures.Inc("write")
+        remove_in_root(tmp, false)
+        return n, err
+    }
+    return n, nil
+}
+
+
+// stat_handler answers GET /_/api/v1/stat?path=/docs/, a missing path is
+// not an error: exists is false.
+//   curl 'http://127.0.0.1:9898/_/api/v1/stat?path=/docs/'
+func stat_handler(w http.ResponseWriter, r *http.Request) {
+    upath, err := apiPath(r.URL.Query().Get("path"))
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    writeJSON(w, 200, stat_path(upath))
+}
+
+
+//   curl 'http://127.0.0.1:9898/_/api/v1/list?path=/docs/&offset=100&limit=100'
+func list_api(w http.ResponseWriter, r *http.Request) {
+    upath, err := apiPath(r.URL.Query().Get("path"))
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    pg, err := pageParams(r)
+    if err != nil {
+        serveError(w, r, 400, err.Error())
+        return
+    }
+    withHash := false
+    switch r.URL.Query().Get("hash") {
+    case "":
+    case "sha256":
+        withHash = true
+    default:
+        serveError(w, r, 400, "hash must be sha256")
+        return
+    }
+    rel := strings.TrimPrefix(upath, "/")
+    fi, err := lookup(upath)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    if !fi.IsDir() {
+        serveError(w, r, 409, "not a directory")
+        return
+    }
+    f, err := open_in_root(dst, rel)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    ents, err := f.ReadDir(-1)
+    f.Close()
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+
+    hc := newHideChecker()
+    res := listResult{Path: upath, Entries: []apiEntry{}}
+    var all []apiEntry
+    var infos []fs.FileInfo
+    for _, e := range ents {
+        info, err := e.Info()
+        if err != nil {
+            continue
+        }
+        erel := path.Join(rel, e.Name())
+        var link string
+        if info.Mode()&fs.ModeSymlink != 0 {
+            var ok bool
+            if link, info, ok = linkTarget(erel); !ok {
+                continue
+            }
+        }
+        if hc.hidden(erel, info.IsDir()) {
+            continue
+        }
+        typ := "file"
+        if info.IsDir() {
+            typ = "dir"
+        }
+        all = append(all, apiEntry{Name: e.Name(), Path: "/" + erel, Type: typ,
+            Size: info.Size(), ModTime: info.ModTime(), Link: link})
+        infos = append(infos, info)
+    }
+    res.Total = len(all)
+    lo, hi := pg.cut(len(all))
+    res.Entries = append(res.Entries, all[lo:hi]...)
+    if withHash {
+        // only the page is hashed, that is what was asked for.
+        for i := range res.Entries {
+            e := &res.Entries[i]
+            if e.Type != "file" {
+                continue
+            }
+            erel := strings.TrimPrefix(e.Path, "/")
+            var err error
+            if e.SHA256, err = file_sha256(erel, infos[lo+i]); err != nil {
+                log.Printf("sha256 %s: %v", erel, err)
+            }
+        }
+    }
+    res.apiPage = pg
+    writeJSON(w, 200, res)
+}
+
+
+// files_api downloads (GET), uploads (PUT) and deletes (DELETE) one path.
+//   curl -T a.txt 'http://127.0.0.1:9898/_/api/v1/files?path=/docs/a.txt&overwrite=true'
+func files_api(w http.ResponseWriter, r *http.Request) {
+    upath, err := apiPath(r.URL.Query().Get("path"))
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    switch r.Method {
+    case "GET", "HEAD":
+        fi, err := lookup(upath)
+        if err != nil {
+            httpError(w, r, err)
+            return
+        }
+        if fi.IsDir() {
+            serveError(w, r, 409, "is a directory, see /_/api/v1/list")
+            return
+        }
+        w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name()}))
+        serveFile(w, r, Dir(dst), upath, false)
+    case "PUT":
+        mActiveUploads.Add(1)
+        defer mActiveUploads.Add(-1)
+        tu, done := track_upload(w, r, upath)
+        defer done()
+        tu.setFile(upath)
+        throttleUpload(r)
+        if r.URL.Query().Get("offset") != "" {
+            put_resumable(w, r, upath)
+            return
+        }
+        if boolParam(r, "extract") {
+            // path is the directory to unpack into.
+            put_archive(w, r, upath)
+            return
+        }
+        if _, err := save_file(r, upath, r.Body, boolParam(r, "overwrite")); err != nil {
+            log.Printf("api upload %s: %v", upath, err)
+            apiFail(w, r, err)
+            return
+        }
+        writeJSON(w, 201, stat_path(upath))
+    case "DELETE":
+        if !apiWriteAllowed(w, r) {
+            return
+        }
+        rel := strings.TrimPrefix(upath, "/")
+        if rel == "" {
+            serveError(w, r, 400, "can't delete the root")
+            return
+        }
+        mode, err := lstat_in_root(rel)
+        if err != nil {
+            httpError(w, r, err)
+            return
+        }
+        if newHideChecker().hidden(rel, mode.IsDir()) {
+            httpError(w, r, fs.ErrNotExist)
+            return
+        }
+        if err := remove_in_root(rel, boolParam(r, "recursive")); err != nil {
+            apiFail(w, r, err)
+            return
+        }
+        audit(r, auditEvent{Action: auditDelete, Path: upath})
+        w.WriteHeader(204)
+    }
+}
+
+
+// upload_api takes a multipart form, every file part goes into path.
+// a part's filename, or a path field before it, may name subfolders,
+// they are created. with extract=1 zip and tar parts are unpacked.
+//   curl -F f=@a.txt -F 'f=@b.txt;filename=sub/b.txt' 'http://127.0.0.1:9898/_/api/v1/upload?path=/docs/'
+func upload_api(w http.ResponseWriter, r *http.Request) {
+    mActiveUploads.Add(1)
+    defer mActiveUploads.Add(-1)
+    upath, err := apiPath(r.URL.Query().Get("path"))
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    if !dir_in_root(strings.TrimPrefix(upath, "/")) {
+        mUploadFailures.Inc("bad_dir")
+        serveError(w, r, 404, "no such directory")
+        return
+    }
+    tu, done := track_upload(w, r, upath)
+    defer done()
+    // before the reader takes hold of the body.
+    throttleUpload(r)
+    mr, err := r.MultipartReader()
+    if err != nil {
+        mUploadFailures.Inc("parse")
+        serveError(w, r, 400, "bad multipart form")
+        return
+    }
+    overwrite := boolParam(r, "overwrite")
+    extract := boolParam(r, "extract")
+    res := uploadResult{Files: []statInfo{}}
+    field := ""
+    hc := newHideChecker()
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            if tu.wasCanceled() {
+                serveError(w, r, 400, "upload canceled")
+                return
+            }
+            mUploadFailures.Inc("parse")
+            serveError(w, r, 400, "bad multipart form")
+            return
+        }
+        if part.FileName() == "" {
+            if part.FormName() == "path" {
+                b, _ := io.ReadAll(io.LimitReader(part, 4096))
+                field = string(b)
+            }
+            continue
+        }
+        name, err := upload_name(part.Header, field)
+        field = ""
+        if err != nil {
+            serveError(w, r, 400, "bad file name")
+            return
+        }
+        target := path.Join(upath, name)
+        if hc.hidden(strings.TrimPrefix(target, "/"), false) {
+            res.Skipped = append(res.Skipped, target)
+            continue
+        }
+        if strings.Contains(name, "/") {
+            if err := make_dirs(path.Dir(target)); err != nil {
+                apiFail(w, r, err)
+                return
+            }
+        }
+        tu.setFile(target)
+        br := bufio.NewReader(part)
+        if extract && is_archive(br) {
+            ar, err := extract_upload(r, br, target, path.Dir(target), overwrite)
+            if err != nil {
+                log.Printf("api upload %s: %v", target, err)
+                extractFail(w, r, err)
+                return
+            }
+            res.Archives = append(res.Archives, ar)
+            continue
+        }
+        if _, err := save_file(r, target, br, overwrite); err != nil {
+            log.Printf("api upload %s: %v", target, err)
+            apiFail(w, r, err)
+            return
+        }
+        res.Files = append(res.Files, stat_path(target))
+    }
+    writeJSON(w, 201, res)
+}
+
+
+//   curl -H 'Content-Type: application/json' -d '{"from":"/a.txt","to":"/docs/a.txt"}' http://127.0.0.1:9898/_/api/v1/move
+func move_api(w http.ResponseWriter, r *http.Request) {
+    if !apiWriteAllowed(w, r) {
+        return
+    }
+    var req moveRequest
+    if err := readJSON(r, &req); err != nil {
+        serveError(w, r, 400, "bad request: "+err.Error())
+        return
+    }
+    from, err := apiPath(req.From)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    to, err := apiPath(req.To)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    if from == "/" || to == "/" || from == to || strings.HasPrefix(to, from+"/") {
+        serveError(w, r, 400, "can't move "+from+" to "+to)
+        return
+    }
+    frel, trel := strings.TrimPrefix(from, "/"), strings.TrimPrefix(to, "/")
+    mode, err := lstat_in_root(frel)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    if newHideChecker().hidden(frel, mode.IsDir()) {
+        httpError(w, r, fs.ErrNotExist)
+        return
+    }
+    if err := writeTarget(to, mode.IsDir()); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    if tmode, err := lstat_in_root(trel); err == nil {
+        if !req.Overwrite || tmode.IsDir() != mode.IsDir() {
+            serveError(w, r, 409, to+" exists")
+            return
+        }
+    }
+    if err := rename_in_root(frel, trel); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    audit(r, auditEvent{Action: auditRename, Path: from, Target: to})
+    writeJSON(w, 200, stat_path(to))
+}
+
+
+//   curl -H 'Content-Type: application/json' -d '{"path":"/a/b","parents":true}' http://127.0.0.1:9898/_/api/v1/mkdir
+func mkdir_api(w http.ResponseWriter, r *http.Request) {
+    var req mkdirRequest
+    if err := readJSON(r, &req); err != nil {
+        serveError(w, r, 400, "bad request: "+err.Error())
+        return
+    }
+    upath, err := apiPath(req.Path)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    if upath == "/" {
+        serveError(w, r, 409, "exists")
+        return
+    }
+    if req.Parents {
+        err = make_dirs(upath)
+    } else if _, lerr := lstat_in_root(strings.TrimPrefix(upath, "/")); lerr == nil {
+        err = &fs.PathError{Op: "mkdir", Path: upath, Err: fs.ErrExist}
+    } else if err = writeTarget(upath, true); err == nil {
+        err = mkdir_in_root(strings.TrimPrefix(upath, "/"), 0755)
+    }
+    if err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    writeJSON(w, 201, stat_path(upath))
+}
+
+
+// make_dirs creates upath and its missing parents, like mkdir -p.
+func make_dirs(upath string) error {
+    var dirs []string
+    for p := path.Clean(upath); p != "/"; p = path.Dir(p) {
+        dirs = append([]string{p}, dirs...)
+    }
+    for _, d := range dirs {
+        rel := strings.TrimPrefix(d, "/")
+        if mode, err := lstat_in_root(rel); err == nil {
+            if dir_in_root(rel) {
+                continue
+            }
+            if !mode.IsDir() {
+                return &fs.PathError{Op: "mkdir", Path: d, Err: syscall.ENOTDIR}
+            }
+        }
+        if err := writeTarget(d, true); err != nil {
+            return err
+        }
+        // another upload of the same tree may have been quicker.
+        if err := mkdir_in_root(rel, 0755); err != nil && !(errors.Is(err, fs.ErrExist) && dir_in_root(rel)) {
+            return err
+        }
+    }
+    return nil
+}
+
+
+// upload_name is the relative path a multipart file part asks for: the
+// raw filename, which may carry a folder (webkitRelativePath), or the
+// path field sent before the part. "..", absolute paths and empty
+// names are refused.
+func upload_name(h textproto.MIMEHeader, field string) (string, error) {
+    name := field
+    if name == "" {
+        _, params, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+        if err != nil {
+            return "", errInvalidPath
+        }
+        name = params["filename"]
+    }
+    return clean_upload_name(name)
+}
+
+
+func clean_upload_name(name string) (string, error) {
+    name = strings.ReplaceAll(name, `\`, "/")
+    if strings.HasPrefix(name, "/") || strings.ContainsRune(name, 0) || containsDotDot(name) {
+        return "", errInvalidPath
+    }
+    var parts []string
+    for _, c := range strings.Split(name, "/") {
+        if c != "" && c != "." {
+            parts = append(parts, c)
+        }
+    }
+    if len(parts) == 0 || len(parts) > maxUploadDepth {
+        return "", errInvalidPath
+    }
+    return strings.Join(parts, "/"), nil
+}
+
+
+// search_api is /search with json pages in place of a stream.
+//   curl 'http://127.0.0.1:9898/_/api/v1/search?q=*.log&mode=glob&path=/logs/&limit=50'
+func search_api(w http.ResponseWriter, r *http.Request) {
+    pg, err := pageParams(r)
+    if err != nil {
+        serveError(w, r, 400, err.Error())
+        return
+    }
+    q := r.URL.Query()
+    q.Del("limit")
+    r.URL.RawQuery = q.Encode()
+    sq, err := parse_search_query(r)
+    if err != nil {
+        serveError(w, r, 400, "bad search: "+err.Error())
+        return
+    }
+    if sq.mode == "content" && fts == nil {
+        serveError(w, r, 400, "bad search: content search needs the server started with -ftsindex")
+        return
+    }
+    if !search_base_ok(sq.base) {
+        httpError(w, r, fs.ErrNotExist)
+        return
+    }
+    // one more than the page tells whether there is a next one.
+    var found []searchResult
+    want := pg.Offset + pg.Limit + 1
+    run_search(r.Context(), sq, func(res searchResult) bool {
+        found = append(found, res)
+        return len(found) < want
+    })
+    res := searchResults{Query: q.Get("q"), Mode: sq.mode, Path: sq.base, Results: []searchResult{}}
+    lo, hi := pg.cut(len(found))
+    res.Results = append(res.Results, found[lo:hi]...)
+    res.apiPage = pg
+    writeJSON(w, 200, res)
+}
@@ -0,0 +1,120 @@
+package main
+
+// static assets (favicon, html, js), embedded in the binary.
+// auth: github.com/liikii
+
+import "crypto/sha256"
+import "embed"
+import "encoding/hex"
+import "io"
+import "io/fs"
+import "net/http"
+import "os"
+import "path"
+import "strings"
+import "time"
+
+
+//go:embed static
+var staticFS embed.FS
+
+// assets is the embedded static directory, or -static from disk.
+var assets fs.FS
+
+// asset name -> short content hash.
+var assetHashes = map[string]string{}
+
+// hashed url name -> asset name.
+var hashedAssets = map[string]string{}
+
+
+// hashedName: jquery.min.js -> jquery.min.0123abcd.js
+func hashedName(name, hash string) string {
+    ext := path.Ext(name)
+    return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+
+// load_assets hashes every asset, dir "" means the embedded ones.
+func load_assets(dir string) error {
+    if dir != "" {
+        assets = os.DirFS(dir)
+    } else {
+        sub, err := fs.Sub(staticFS, "static")
+        if err != nil {
+            return err
+        }
+        assets = sub
+    }
+    return fs.WalkDir(assets, ".", func(p string, d fs.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+            return err
+        }
+        f, err := assets.Open(p)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        h := sha256.New()
+        if _, err := io.Copy(h, f); err != nil {
+            return err
+        }
+        sum := hex.EncodeToString(h.Sum(nil))[:12]
+        assetHashes[p] = sum
+        hashedAssets[hashedName(p, sum)] = p
+        return nil
+    })
+}
+
+
+// assetURL is the cache busting url of an asset, for templates.
+func assetURL(name string) string {
+    if h, ok := assetHashes[name]; ok {
+        return "/s/" + hashedName(name, h)
+    }
+    return "/s/" + name
+}
+
+
+// serveAsset: hashed names never change and are cached for a year,
+// plain names are revalidated with their etag.
+func serveAsset(w http.ResponseWriter, r *http.Request, name string) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        serveError(w, r, 405, "405 method not allowed")
+        return
+    }
+    immutable := false
+    if n, ok := hashedAssets[name]; ok {
+        name = n
+        immutable = true
+    }
+    hash, ok := assetHashes[name]
+    if !ok {
+        serveError(w, r, 404, "404 page not found")
+        return
+    }
+    f, err := assets.Open(name)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    defer f.Close()
+    rs, ok := f.(io.ReadSeeker)
+    if !ok {
+        serveError(w, r, 500, "asset is not seekable")
+        return
+    }
+    if immutable {
+        w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+    } else {
+        w.Header().Set("Cache-Control", "no-cache")
+    }
+    w.Header().Set("Etag", `"`+hash+`"`)
+    serveContent(w, r, name, time.Time{}, rs)
+}
+
+
+func static_handler(w http.ResponseWriter, r *http.Request) {
+    serveAsset(w, r, strings.TrimPrefix(path.Clean(r.URL.Path), "/s/"))
+}
+
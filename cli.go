@@ -0,0 +1,451 @@
+package main
+
+// client subcommands: trans get|put|ls|rm|sync|wait|watch, the same binary as the
+// server, talking to it through the client package.
+// auth: github.com/liikii
+
+import "context"
+import "errors"
+import "flag"
+import "fmt"
+import "io/fs"
+import "os"
+import "os/signal"
+import "path"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "time"
+
+import "example.com/client"
+
+
+type clientCommand struct {
+    usage string
+    run   func(co *clientOpts, args []string) error
+}
+
+
+var clientCommands = map[string]clientCommand{
+    "ls":    {"ls [-r] REMOTE...", cmd_ls},
+    "get":   {"get [-r] REMOTE... LOCAL", cmd_get},
+    "put":   {"put [-r] [-f] LOCAL... REMOTE", cmd_put},
+    "rm":    {"rm [-r] REMOTE...", cmd_rm},
+    "sync":  {"sync [-pull] [-delete] [-checksum] [-n] LOCAL_DIR REMOTE_DIR", cmd_sync},
+    "wait":  {"wait [-timeout D] REMOTE", cmd_wait},
+    "watch": {"watch [-r] REMOTE", cmd_watch},
+}
+
+
+// clientOpts are the flags every subcommand takes.
+type clientOpts struct {
+    c         *client.Client
+    ctx       context.Context
+    jobs      int
+    quiet     bool
+    recursive bool
+    force     bool
+    pull      bool // sync only
+    delete    bool
+    checksum  bool
+    dryRun    bool
+    timeout   time.Duration // wait only
+    fs        *flag.FlagSet
+}
+
+
+func env(name, def string) string {
+    if v := os.Getenv(name); v != "" {
+        return v
+    }
+    return def
+}
+
+
+// run_client runs a subcommand and returns the exit code.
+func run_client(name string, args []string) int {
+    cmd := clientCommands[name]
+    co := &clientOpts{fs: flag.NewFlagSet(name, flag.ContinueOnError)}
+    var server, token, user string
+    co.fs.StringVar(&server, "server", env("TRANS_SERVER", "http://127.0.0.1:9898"), "server url, or TRANS_SERVER.")
+    co.fs.StringVar(&token, "token", os.Getenv("TRANS_TOKEN"), "bearer token, or TRANS_TOKEN.")
+    co.fs.StringVar(&user, "user", os.Getenv("TRANS_USER"), "basic auth user:password, or TRANS_USER.")
+    co.fs.IntVar(&co.jobs, "j", 4, "parallel transfers.")
+    co.fs.BoolVar(&co.quiet, "q", false, "no progress output.")
+    co.fs.BoolVar(&co.recursive, "r", false, "recurse into directories.")
+    co.fs.BoolVar(&co.force, "f", false, "overwrite existing remote files.")
+    if name == "sync" {
+        co.fs.BoolVar(&co.pull, "pull", false, "make LOCAL_DIR like REMOTE_DIR, the default is the other way.")
+        co.fs.BoolVar(&co.delete, "delete", false, "delete what the other side doesn't have.")
+        co.fs.BoolVar(&co.checksum, "checksum", false, "compare files by sha256, not mtime.")
+        co.fs.BoolVar(&co.dryRun, "n", false, "print the plan, change nothing.")
+    }
+    if name == "wait" {
+        co.fs.DurationVar(&co.timeout, "timeout", 0, "give up after this long, 0 waits forever.")
+    }
+    co.fs.Usage = func() {
+        fmt.Fprintf(co.fs.Output(), "usage: trans %s\n", cmd.usage)
+        co.fs.PrintDefaults()
+    }
+    if err := co.fs.Parse(args); err != nil {
+        return 2
+    }
+    if co.jobs < 1 {
+        co.jobs = 1
+    }
+    co.c = client.New(server)
+    co.c.Token = token
+    if user != "" {
+        up := strings.SplitN(user, ":", 2)
+        co.c.User = up[0]
+        if len(up) == 2 {
+            co.c.Password = up[1]
+        }
+    }
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    co.ctx = ctx
+    if err := cmd.run(co, co.fs.Args()); err != nil {
+        fmt.Fprintln(os.Stderr, "trans "+name+":", err)
+        return 1
+    }
+    return 0
+}
+
+
+// remote makes a remote path absolute.
+func remote(p string) string {
+    return client.Join(p)
+}
+
+
+func cmd_ls(co *clientOpts, args []string) error {
+    if len(args) == 0 {
+        args = []string{"/"}
+    }
+    for _, a := range args {
+        p := remote(a)
+        st, err := co.c.Stat(co.ctx, p)
+        if err != nil {
+            return err
+        }
+        if !st.Exists {
+            return fmt.Errorf("%s: no such file or directory", p)
+        }
+        if !st.IsDir() {
+            print_entry(client.Entry{Path: p, Type: st.Type, Size: st.Size, ModTime: st.ModTime})
+            continue
+        }
+        if co.recursive {
+            err = co.c.Walk(co.ctx, p, func(e client.Entry) error { print_entry(e); return nil })
+        } else {
+            var ents []client.Entry
+            if ents, err = co.c.List(co.ctx, p); err == nil {
+                for _, e := range ents {
+                    print_entry(e)
+                }
+            }
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+func print_entry(e client.Entry) {
+    size, name := formatFileSize(e.Size), e.Path
+    if e.IsDir() {
+        size, name = "-", name+"/"
+    }
+    if e.Link != "" {
+        name += " -> " + e.Link
+    }
+    fmt.Printf("%10s  %s  %s\n", size, e.ModTime.Local().Format("2006-01-02 15:04"), name)
+}
+
+
+func cmd_rm(co *clientOpts, args []string) error {
+    if len(args) == 0 {
+        co.fs.Usage()
+        return errors.New("nothing to remove")
+    }
+    for _, a := range args {
+        if err := co.c.Remove(co.ctx, remote(a), co.recursive); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+// cmd_wait returns once REMOTE exists, for scripts waiting on a file.
+func cmd_wait(co *clientOpts, args []string) error {
+    if len(args) != 1 {
+        co.fs.Usage()
+        return errors.New("need REMOTE")
+    }
+    ctx := co.ctx
+    if co.timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, co.timeout)
+        defer cancel()
+    }
+    err := co.c.Wait(ctx, remote(args[0]))
+    if errors.Is(err, context.DeadlineExceeded) {
+        return fmt.Errorf("%s did not appear within %v", remote(args[0]), co.timeout)
+    }
+    return err
+}
+
+
+// cmd_watch prints the changes of REMOTE, one per line.
+func cmd_watch(co *clientOpts, args []string) error {
+    if len(args) != 1 {
+        co.fs.Usage()
+        return errors.New("need REMOTE")
+    }
+    err := co.c.Events(co.ctx, remote(args[0]), co.recursive, func(ev client.Event) error {
+        if ev.Op != "ready" {
+            fmt.Printf("%-7s %-4s %s\n", ev.Op, ev.Type, ev.Path)
+        }
+        return nil
+    })
+    if co.ctx.Err() != nil {
+        return nil
+    }
+    return err
+}
+
+
+func cmd_get(co *clientOpts, args []string) error {
+    if len(args) < 2 {
+        co.fs.Usage()
+        return errors.New("need REMOTE and LOCAL")
+    }
+    local := args[len(args)-1]
+    fi, err := os.Stat(local)
+    intoDir := err == nil && fi.IsDir()
+    if len(args) > 2 && !intoDir {
+        return fmt.Errorf("%s is not a directory", local)
+    }
+    var todo []client.Action
+    for _, a := range args[:len(args)-1] {
+        p := remote(a)
+        st, err := co.c.Stat(co.ctx, p)
+        if err != nil {
+            return err
+        }
+        if !st.Exists {
+            return fmt.Errorf("%s: no such file or directory", p)
+        }
+        dst := local
+        if intoDir {
+            dst = filepath.Join(local, path.Base(p))
+        }
+        if !st.IsDir() {
+            todo = append(todo, client.Action{Op: client.OpGet, Remote: p, Local: dst, Size: st.Size})
+            continue
+        }
+        if !co.recursive {
+            return fmt.Errorf("%s is a directory, use -r", p)
+        }
+        if err := os.MkdirAll(dst, 0777); err != nil {
+            return err
+        }
+        err = co.c.Walk(co.ctx, p, func(e client.Entry) error {
+            lp, err := client.LocalPath(dst, p, e.Path)
+            if err != nil {
+                return err
+            }
+            if e.IsDir() {
+                return os.MkdirAll(lp, 0777)
+            }
+            todo = append(todo, client.Action{Op: client.OpGet, Remote: e.Path, Local: lp, Size: e.Size})
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return run_transfers(co, todo)
+}
+
+
+func cmd_put(co *clientOpts, args []string) error {
+    if len(args) < 2 {
+        co.fs.Usage()
+        return errors.New("need LOCAL and REMOTE")
+    }
+    dst := remote(args[len(args)-1])
+    st, err := co.c.Stat(co.ctx, dst)
+    if err != nil {
+        return err
+    }
+    intoDir := st.IsDir() || strings.HasSuffix(args[len(args)-1], "/")
+    if len(args) > 2 && !intoDir {
+        return fmt.Errorf("%s is not a directory", dst)
+    }
+    var todo []client.Action
+    for _, src := range args[:len(args)-1] {
+        fi, err := os.Stat(src)
+        if err != nil {
+            return err
+        }
+        target := dst
+        if intoDir {
+            target = client.Join(dst, filepath.Base(src))
+        }
+        if !fi.IsDir() {
+            todo = append(todo, client.Action{Op: client.OpPut, Local: src, Remote: target, Size: fi.Size()})
+            continue
+        }
+        if !co.recursive {
+            return fmt.Errorf("%s is a directory, use -r", src)
+        }
+        dirs, files, err := local_tree(src, target)
+        if err != nil {
+            return err
+        }
+        for _, d := range dirs {
+            if err := co.c.Mkdir(co.ctx, d, true); err != nil {
+                return err
+            }
+        }
+        todo = append(todo, files...)
+    }
+    return run_transfers(co, todo)
+}
+
+
+// local_tree lists the directories and the uploads of local dir src to
+// remote dir dst.
+func local_tree(src, dst string) ([]string, []client.Action, error) {
+    var dirs []string
+    var files []client.Action
+    err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, _ := filepath.Rel(src, p)
+        target := client.Join(dst, filepath.ToSlash(rel))
+        if d.IsDir() {
+            dirs = append(dirs, target)
+            return nil
+        }
+        if !d.Type().IsRegular() {
+            return nil
+        }
+        fi, err := d.Info()
+        if err != nil {
+            return err
+        }
+        files = append(files, client.Action{Op: client.OpPut, Local: p, Remote: target, Size: fi.Size()})
+        return nil
+    })
+    return dirs, files, err
+}
+
+
+// cmd_sync makes REMOTE_DIR like LOCAL_DIR, or the other way with -pull.
+// files differing in size or mtime (sha256 with -checksum) are sent.
+func cmd_sync(co *clientOpts, args []string) error {
+    if len(args) != 2 {
+        co.fs.Usage()
+        return errors.New("need LOCAL_DIR and REMOTE_DIR")
+    }
+    opt := client.SyncOptions{Delete: co.delete, Checksum: co.checksum}
+    if co.pull {
+        opt.Direction = client.Pull
+    }
+    plan, err := co.c.Plan(co.ctx, args[0], remote(args[1]), opt)
+    if err != nil {
+        return err
+    }
+    if co.dryRun || !co.quiet {
+        for _, a := range plan {
+            fmt.Println(a)
+        }
+    }
+    if co.dryRun {
+        return nil
+    }
+    co.force = true
+    return run_transfers(co, plan)
+}
+
+
+// progress is the shared state of a batch of transfers.
+type progress struct {
+    total int64
+    done  int64 // bytes, atomic
+    files int64 // atomic
+    count int
+    start time.Time
+}
+
+
+func (p *progress) line() string {
+    done := atomic.LoadInt64(&p.done)
+    pct := 100.0
+    if p.total > 0 {
+        pct = float64(done) * 100 / float64(p.total)
+    }
+    rate := float64(done) / time.Since(p.start).Seconds()
+    return fmt.Sprintf("\r%5.1f%%  %s / %s  %s/s  %d/%d files  ", pct, formatFileSize(done),
+        formatFileSize(p.total), formatFileSize(int64(rate)), atomic.LoadInt64(&p.files), p.count)
+}
+
+
+// run_transfers runs plan, the transfers on -j workers, with a progress
+// line on a terminal. the first error stops it.
+func run_transfers(co *clientOpts, plan []client.Action) error {
+    if len(plan) == 0 {
+        return nil
+    }
+    pg := &progress{start: time.Now()}
+    for _, a := range plan {
+        if a.Op == client.OpPut || a.Op == client.OpGet {
+            pg.total += a.Size
+            pg.count++
+        }
+    }
+    opt := client.ApplyOptions{
+        Jobs:      co.jobs,
+        Progress:  func(n int64) { atomic.AddInt64(&pg.done, n) },
+        Done:      func(client.Action) { atomic.AddInt64(&pg.files, 1) },
+        NoClobber: !co.force,
+    }
+
+    show := !co.quiet && pg.count > 0 && isTerminal(os.Stderr)
+    stop := make(chan struct{})
+    shown := make(chan struct{})
+    go func() {
+        defer close(shown)
+        if !show {
+            return
+        }
+        tick := time.NewTicker(200 * time.Millisecond)
+        defer tick.Stop()
+        for {
+            select {
+            case <-tick.C:
+                fmt.Fprint(os.Stderr, pg.line())
+            case <-stop:
+                fmt.Fprintln(os.Stderr, pg.line())
+                return
+            }
+        }
+    }()
+    err := co.c.Apply(co.ctx, plan, opt)
+    close(stop)
+    <-shown
+    return err
+}
+
+
+func isTerminal(f *os.File) bool {
+    fi, err := f.Stat()
+    return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
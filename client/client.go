@@ -0,0 +1,531 @@
+// Package client talks to a trans server through its /_/api/v1.
+//
+//   c := client.New("http://127.0.0.1:9898")
+//   c.Token = os.Getenv("TRANS_TOKEN")
+//   err := c.Upload(ctx, "build/app.tar.gz", "/builds/app.tar.gz", client.UploadOptions{Overwrite: true})
+//
+// uploads and downloads resume where they stopped, after a dropped
+// connection or on the next run.
+package client
+
+// auth: github.com/liikii
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "net/url"
+import "os"
+import "path"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+
+// attempts of one transfer before giving up, each resumes.
+const retries = 5
+
+const partSuffix = ".trans-part"
+
+// where the server keeps its api.
+const apiPrefix = "/_/api/v1"
+
+
+// Client of one server. Token is sent as a bearer token, User and
+// Password as basic auth, both when set.
+type Client struct {
+    BaseURL  string
+    Token    string
+    User     string
+    Password string
+    HTTP     *http.Client
+}
+
+
+// Error is an error answer of the server.
+type Error struct {
+    Code      int    `json:"code"`
+    Status    string `json:"status"`
+    Message   string `json:"message"`
+    RequestID string `json:"request_id"`
+}
+
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("%d %s: %s (request id %s)", e.Code, e.Status, e.Message, e.RequestID)
+}
+
+
+// IsNotFound reports whether err is a 404 of the server.
+func IsNotFound(err error) bool {
+    var e *Error
+    return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
+
+
+// Stat describes a path, see /_/api/v1/stat.
+type Stat struct {
+    Path     string    `json:"path"`
+    Exists   bool      `json:"exists"`
+    Type     string    `json:"type"`
+    Size     int64     `json:"size"`
+    ModTime  time.Time `json:"mtime"`
+    Writable bool      `json:"writable"`
+    Free     uint64    `json:"free"`
+}
+
+
+func (s *Stat) IsDir() bool { return s.Type == "dir" }
+
+
+// Entry is one entry of a directory listing.
+type Entry struct {
+    Name    string    `json:"name"`
+    Path    string    `json:"path"`
+    Type    string    `json:"type"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mtime"`
+    Link    string    `json:"link,omitempty"`
+    SHA256  string    `json:"sha256,omitempty"`
+}
+
+
+func (e *Entry) IsDir() bool { return e.Type == "dir" }
+
+
+// New returns a client of the server at base, e.g. http://host:9898.
+func New(base string) *Client {
+    return &Client{BaseURL: strings.TrimRight(base, "/"), HTTP: &http.Client{}}
+}
+
+
+func (c *Client) url(p string, q url.Values) string {
+    u := c.BaseURL + apiPrefix + p
+    if len(q) > 0 {
+        u += "?" + q.Encode()
+    }
+    return u
+}
+
+
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader, hdr http.Header) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, method, u, body)
+    if err != nil {
+        return nil, err
+    }
+    return c.send(req, hdr)
+}
+
+
+// decode reads a json answer into v, or the error answer.
+func decode(resp *http.Response, v interface{}) error {
+    defer resp.Body.Close()
+    if resp.StatusCode >= 400 {
+        return readError(resp)
+    }
+    if v == nil {
+        io.Copy(io.Discard, resp.Body)
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+
+func readError(resp *http.Response) error {
+    e := &Error{Code: resp.StatusCode, Status: http.StatusText(resp.StatusCode)}
+    b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    if json.Unmarshal(b, e) != nil {
+        e.Message = strings.TrimSpace(string(b))
+    }
+    return e
+}
+
+
+func (c *Client) getJSON(ctx context.Context, p string, q url.Values, v interface{}) error {
+    resp, err := c.do(ctx, "GET", c.url(p, q), nil, nil)
+    if err != nil {
+        return err
+    }
+    return decode(resp, v)
+}
+
+
+func (c *Client) postJSON(ctx context.Context, p string, in, out interface{}) error {
+    b, err := json.Marshal(in)
+    if err != nil {
+        return err
+    }
+    resp, err := c.do(ctx, "POST", c.url(p, nil), bytes.NewReader(b), http.Header{"Content-Type": {"application/json"}})
+    if err != nil {
+        return err
+    }
+    return decode(resp, out)
+}
+
+
+// Stat describes remote path p, Exists is false when it is missing.
+func (c *Client) Stat(ctx context.Context, p string) (*Stat, error) {
+    var st Stat
+    if err := c.getJSON(ctx, "/stat", url.Values{"path": {p}}, &st); err != nil {
+        return nil, err
+    }
+    return &st, nil
+}
+
+
+// List returns all entries of directory p, following the pages.
+func (c *Client) List(ctx context.Context, p string) ([]Entry, error) {
+    return c.list(ctx, p, false)
+}
+
+
+// list with hash asks the server for the sha256 of every file.
+func (c *Client) list(ctx context.Context, p string, hash bool) ([]Entry, error) {
+    var all []Entry
+    offset := 0
+    for {
+        var page struct {
+            Entries []Entry `json:"entries"`
+            Next    *int    `json:"next"`
+        }
+        q := url.Values{"path": {p}, "offset": {strconv.Itoa(offset)}, "limit": {"1000"}}
+        if hash {
+            q.Set("hash", "sha256")
+        }
+        if err := c.getJSON(ctx, "/list", q, &page); err != nil {
+            return nil, err
+        }
+        all = append(all, page.Entries...)
+        if page.Next == nil {
+            return all, nil
+        }
+        offset = *page.Next
+    }
+}
+
+
+// Walk calls fn for every entry below directory p, parents first.
+func (c *Client) Walk(ctx context.Context, p string, fn func(e Entry) error) error {
+    return c.walk(ctx, p, false, fn)
+}
+
+
+func (c *Client) walk(ctx context.Context, p string, hash bool, fn func(e Entry) error) error {
+    ents, err := c.list(ctx, p, hash)
+    if err != nil {
+        return err
+    }
+    for _, e := range ents {
+        if err := fn(e); err != nil {
+            return err
+        }
+        if e.IsDir() {
+            if err := c.walk(ctx, e.Path, hash, fn); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+
+// Remove deletes p, a directory that is not empty needs recursive.
+func (c *Client) Remove(ctx context.Context, p string, recursive bool) error {
+    q := url.Values{"path": {p}}
+    if recursive {
+        q.Set("recursive", "true")
+    }
+    resp, err := c.do(ctx, "DELETE", c.url("/files", q), nil, nil)
+    if err != nil {
+        return err
+    }
+    return decode(resp, nil)
+}
+
+
+// Mkdir creates directory p, with its parents when asked.
+func (c *Client) Mkdir(ctx context.Context, p string, parents bool) error {
+    return c.postJSON(ctx, "/mkdir", map[string]interface{}{"path": p, "parents": parents}, nil)
+}
+
+
+// Move renames from to to.
+func (c *Client) Move(ctx context.Context, from, to string, overwrite bool) error {
+    return c.postJSON(ctx, "/move", map[string]interface{}{"from": from, "to": to, "overwrite": overwrite}, nil)
+}
+
+
+// Progress is called with the bytes moved since its last call.
+type Progress func(n int64)
+
+
+type progressReader struct {
+    r  io.Reader
+    fn Progress
+}
+
+
+func (pr progressReader) Read(b []byte) (int, error) {
+    n, err := pr.r.Read(b)
+    if n > 0 && pr.fn != nil {
+        pr.fn(int64(n))
+    }
+    return n, err
+}
+
+
+type UploadOptions struct {
+    Overwrite bool
+    Progress  Progress
+}
+
+
+// Upload sends local file src to remote path dst. what the server
+// already holds of an earlier attempt is not sent again.
+func (c *Client) Upload(ctx context.Context, src, dst string, opt UploadOptions) error {
+    f, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    var last error
+    for attempt := 0; attempt < retries; attempt++ {
+        if attempt > 0 {
+            select {
+            case <-ctx.Done():
+                return ctx.Err()
+            case <-time.After(time.Duration(attempt) * time.Second):
+            }
+        }
+        var st struct {
+            Offset int64      `json:"offset"`
+            MTime  *time.Time `json:"mtime"`
+        }
+        if err := c.getJSON(ctx, "/uploads", url.Values{"path": {dst}}, &st); err != nil {
+            return err
+        }
+        stale := st.MTime != nil && st.MTime.Unix() != fi.ModTime().Unix()
+        if st.Offset > fi.Size() || (st.Offset > 0 && stale) {
+            // a different file was started there.
+            resp, err := c.do(ctx, "DELETE", c.url("/uploads", url.Values{"path": {dst}}), nil, nil)
+            if err != nil {
+                return err
+            }
+            if err := decode(resp, nil); err != nil {
+                return err
+            }
+            st.Offset = 0
+        }
+        if _, err := f.Seek(st.Offset, io.SeekStart); err != nil {
+            return err
+        }
+        if opt.Progress != nil {
+            opt.Progress(st.Offset)
+        }
+        q := url.Values{
+            "path":   {dst},
+            "offset": {strconv.FormatInt(st.Offset, 10)},
+            "total":  {strconv.FormatInt(fi.Size(), 10)},
+            "mtime":  {fi.ModTime().UTC().Format(time.RFC3339Nano)},
+        }
+        if opt.Overwrite {
+            q.Set("overwrite", "true")
+        }
+        body := io.Reader(progressReader{io.LimitReader(f, fi.Size()-st.Offset), opt.Progress})
+        hdr := http.Header{"Content-Type": {"application/octet-stream"}}
+        req, err := http.NewRequestWithContext(ctx, "PUT", c.url("/files", q), body)
+        if err != nil {
+            return err
+        }
+        req.ContentLength = fi.Size() - st.Offset
+        if req.ContentLength == 0 {
+            req.Body = http.NoBody
+        }
+        resp, err := c.send(req, hdr)
+        if err == nil {
+            err = decode(resp, nil)
+            if err == nil {
+                return nil
+            }
+            // only a lost connection or a server error is worth a retry.
+            var e *Error
+            if errors.As(err, &e) && e.Code < 500 && e.Code != http.StatusConflict {
+                return err
+            }
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if opt.Progress != nil {
+            // the next attempt counts again from the server's offset.
+            pos, _ := f.Seek(0, io.SeekCurrent)
+            opt.Progress(-pos)
+        }
+        last = err
+    }
+    return last
+}
+
+
+func (c *Client) send(req *http.Request, hdr http.Header) (*http.Response, error) {
+    for k, v := range hdr {
+        req.Header[k] = v
+    }
+    req.Header.Set("Accept", "application/json")
+    if c.Token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.Token)
+    } else if c.User != "" {
+        req.SetBasicAuth(c.User, c.Password)
+    }
+    return c.HTTP.Do(req)
+}
+
+
+type DownloadOptions struct {
+    Progress Progress
+}
+
+
+// Download fetches remote file src into local path dst. the bytes go
+// to dst.trans-part first, an interrupted download continues from there
+// if the remote file did not change. dst gets the remote mtime.
+func (c *Client) Download(ctx context.Context, src, dst string, opt DownloadOptions) error {
+    st, err := c.Stat(ctx, src)
+    if err != nil {
+        return err
+    }
+    if !st.Exists {
+        return &Error{Code: 404, Status: "Not Found", Message: src + " does not exist"}
+    }
+    if st.IsDir() {
+        return fmt.Errorf("%s is a directory", src)
+    }
+    part := dst + partSuffix
+    var last error
+    for attempt := 0; attempt < retries; attempt++ {
+        if attempt > 0 {
+            select {
+            case <-ctx.Done():
+                return ctx.Err()
+            case <-time.After(time.Duration(attempt) * time.Second):
+            }
+        }
+        err := c.fetch(ctx, src, part, st, opt.Progress)
+        if err == nil {
+            if err := os.Rename(part, dst); err != nil {
+                return err
+            }
+            return os.Chtimes(dst, time.Now(), st.ModTime)
+        }
+        var e *Error
+        if ctx.Err() != nil || (errors.As(err, &e) && e.Code < 500) {
+            return err
+        }
+        last = err
+    }
+    return last
+}
+
+
+// fetch appends to part what it lacks of src. If-Range makes the server
+// send the whole file when it changed since st.
+func (c *Client) fetch(ctx context.Context, src, part string, st *Stat, progress Progress) error {
+    f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0666)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    // the part carries the mtime of the file it was started from.
+    have := fi.Size()
+    if fi.ModTime().Unix() != st.ModTime.Unix() {
+        have = 0
+    }
+    defer os.Chtimes(part, time.Now(), st.ModTime)
+    hdr := http.Header{}
+    if have > 0 && have < st.Size {
+        hdr.Set("Range", "bytes="+strconv.FormatInt(have, 10)+"-")
+        hdr.Set("If-Range", st.ModTime.UTC().Format(http.TimeFormat))
+    } else if have >= st.Size {
+        have = 0
+    }
+    resp, err := c.do(ctx, "GET", c.url("/files", url.Values{"path": {src}}), nil, hdr)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusPartialContent:
+    case http.StatusOK:
+        have = 0
+    default:
+        return readError(resp)
+    }
+    if err := f.Truncate(have); err != nil {
+        return err
+    }
+    if _, err := f.Seek(have, io.SeekStart); err != nil {
+        return err
+    }
+    if progress != nil {
+        progress(have)
+    }
+    n, err := io.Copy(f, progressReader{resp.Body, progress})
+    if err != nil {
+        if progress != nil {
+            progress(-(have + n))
+        }
+        return err
+    }
+    want := st.Size
+    if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+        // changed since the stat, take what was sent.
+        want = resp.ContentLength
+    }
+    if have+n != want {
+        return io.ErrUnexpectedEOF
+    }
+    return nil
+}
+
+
+// Join makes a remote path, like path.Join but always "/" first.
+func Join(elem ...string) string {
+    return path.Clean("/" + path.Join(elem...))
+}
+
+
+// RelPath is remote relative to the directory base. a path the server
+// lists outside base, or not in clean form, is an error: a confused or
+// hostile server must not get files written elsewhere.
+func RelPath(base, remote string) (string, error) {
+    prefix := strings.TrimSuffix(Join(base), "/") + "/"
+    rel := strings.TrimPrefix(remote, prefix)
+    if !strings.HasPrefix(remote, prefix) || rel == "" || path.IsAbs(rel) || path.Clean(rel) != rel ||
+        rel == ".." || strings.HasPrefix(rel, "../") || strings.ContainsRune(rel, 0) ||
+        (filepath.Separator != '/' && strings.ContainsAny(rel, `\:`)) {
+        return "", fmt.Errorf("server listed %q, not a path below %s", remote, base)
+    }
+    return rel, nil
+}
+
+
+// LocalPath turns a remote path relative to base into a local one below dir.
+func LocalPath(dir, base, remote string) (string, error) {
+    rel, err := RelPath(base, remote)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
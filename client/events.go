@@ -0,0 +1,109 @@
+package client
+
+// auth: github.com/liikii
+
+import "bufio"
+import "context"
+import "encoding/json"
+import "errors"
+import "net/url"
+import "strings"
+import "time"
+
+
+// Event is a change of a watched path. Op is create, write, remove or
+// reset, after which the watcher has to look again since events were
+// lost. the first event is ready, with the path as it was then.
+type Event struct {
+    Op      string    `json:"op"`
+    Path    string    `json:"path"`
+    Type    string    `json:"type"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mtime"`
+    Exists  bool      `json:"exists"` // ready only
+}
+
+
+// ErrStop returned by an Events callback ends the stream without error.
+var ErrStop = errors.New("stop")
+
+
+// Events calls fn for the changes of the entries of directory p, or of
+// p alone when it is not a directory, until ctx is done or fn returns
+// an error.
+func (c *Client) Events(ctx context.Context, p string, recursive bool, fn func(Event) error) error {
+    q := url.Values{"path": {p}}
+    if recursive {
+        q.Set("recursive", "true")
+    }
+    resp, err := c.do(ctx, "GET", c.url("/events", q), nil, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 200 {
+        return readError(resp)
+    }
+    sc := bufio.NewScanner(resp.Body)
+    sc.Buffer(make([]byte, 64<<10), 1<<20)
+    var name, data string
+    for sc.Scan() {
+        line := sc.Text()
+        switch {
+        case line == "":
+            if name == "" {
+                continue
+            }
+            var ev Event
+            if err := json.Unmarshal([]byte(data), &ev); err != nil {
+                return err
+            }
+            ev.Op = name
+            name, data = "", ""
+            if err := fn(ev); err != nil {
+                if err == ErrStop {
+                    return nil
+                }
+                return err
+            }
+        case strings.HasPrefix(line, "event: "):
+            name = strings.TrimPrefix(line, "event: ")
+        case strings.HasPrefix(line, "data: "):
+            data = strings.TrimPrefix(line, "data: ")
+        }
+    }
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    if err := sc.Err(); err != nil {
+        return err
+    }
+    return errors.New("event stream closed by the server")
+}
+
+
+// Wait returns once remote path p exists, right away if it does.
+func (c *Client) Wait(ctx context.Context, p string) error {
+    p = Join(p)
+    return c.Events(ctx, p, false, func(ev Event) error {
+        switch ev.Op {
+        case "ready":
+            if ev.Exists {
+                return ErrStop
+            }
+        case "create", "write":
+            if ev.Path == p {
+                return ErrStop
+            }
+        case "reset":
+            st, err := c.Stat(ctx, p)
+            if err != nil {
+                return err
+            }
+            if st.Exists {
+                return ErrStop
+            }
+        }
+        return nil
+    })
+}
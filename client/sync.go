@@ -0,0 +1,385 @@
+package client
+
+// auth: github.com/liikii
+
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "io"
+import "io/fs"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+
+
+// Direction of a sync, Push makes the remote directory like the local
+// one, Pull the other way.
+type Direction int
+
+const (
+    Push Direction = iota
+    Pull
+)
+
+
+type SyncOptions struct {
+    Direction Direction
+    // Delete removes what the source side doesn't have.
+    Delete bool
+    // Checksum compares files of the same size by sha256 instead of
+    // mtime, the server hashes with ?hash=sha256.
+    Checksum bool
+}
+
+
+// Op of an Action.
+const (
+    OpMkdir = "mkdir" // Remote for a push, Local for a pull
+    OpPut   = "put"
+    OpGet   = "get"
+    OpRm    = "rm"    // Remote for a push, Local for a pull
+)
+
+
+// Action is one step of a sync plan.
+type Action struct {
+    Op     string
+    Local  string
+    Remote string
+    Size   int64
+    Reason string // new, size, mtime, sha256 or extraneous
+}
+
+
+func (a Action) String() string {
+    switch a.Op {
+    case OpPut:
+        return fmt.Sprintf("put    %s -> %s  (%s)", a.Local, a.Remote, a.Reason)
+    case OpGet:
+        return fmt.Sprintf("get    %s -> %s  (%s)", a.Remote, a.Local, a.Reason)
+    case OpMkdir, OpRm:
+        if a.Remote != "" {
+            return fmt.Sprintf("%-6s %s", a.Op, a.Remote)
+        }
+        return fmt.Sprintf("%-6s %s", a.Op, a.Local)
+    }
+    return a.Op
+}
+
+
+// fileMeta is one side's view of a path of the tree.
+type fileMeta struct {
+    dir    bool
+    size   int64
+    mtime  int64 // unix seconds
+    sha256 string
+    local  string // local path, for hashing on demand
+}
+
+
+// local_tree lists dir by slash path relative to it. dotfiles and parts
+// of downloads are left out, the server doesn't show its own either.
+func local_tree(dir string) (map[string]*fileMeta, error) {
+    tree := map[string]*fileMeta{}
+    err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if p == dir {
+            return nil
+        }
+        name := d.Name()
+        if strings.HasPrefix(name, ".") || strings.HasSuffix(name, partSuffix) {
+            if d.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        rel, _ := filepath.Rel(dir, p)
+        rel = filepath.ToSlash(rel)
+        if d.IsDir() {
+            tree[rel] = &fileMeta{dir: true}
+            return nil
+        }
+        // links are followed, like the server does.
+        fi, err := os.Stat(p)
+        if err != nil {
+            return nil
+        }
+        if fi.IsDir() {
+            return nil
+        }
+        tree[rel] = &fileMeta{size: fi.Size(), mtime: fi.ModTime().Unix(), local: p}
+        return nil
+    })
+    return tree, err
+}
+
+
+// remote_tree is local_tree of a remote directory, nil if it is missing.
+func (c *Client) remote_tree(ctx context.Context, dir string, hash bool) (map[string]*fileMeta, error) {
+    st, err := c.Stat(ctx, dir)
+    if err != nil || !st.Exists {
+        return nil, err
+    }
+    if !st.IsDir() {
+        return nil, fmt.Errorf("%s is not a directory", dir)
+    }
+    tree := map[string]*fileMeta{}
+    err = c.walk(ctx, dir, hash, func(e Entry) error {
+        rel, err := RelPath(dir, e.Path)
+        if err != nil {
+            return err
+        }
+        tree[rel] = &fileMeta{dir: e.IsDir(), size: e.Size, mtime: e.ModTime.Unix(), sha256: e.SHA256}
+        return nil
+    })
+    return tree, err
+}
+
+
+func local_sha256(p string) (string, error) {
+    f, err := os.Open(p)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+
+// differ tells why file dst must be replaced by src, "" if it needn't.
+func differ(src, dst *fileMeta, checksum bool) (string, error) {
+    if src.size != dst.size {
+        return "size", nil
+    }
+    if !checksum {
+        if src.mtime != dst.mtime {
+            return "mtime", nil
+        }
+        return "", nil
+    }
+    for _, m := range []*fileMeta{src, dst} {
+        if m.sha256 == "" && m.local != "" {
+            sum, err := local_sha256(m.local)
+            if err != nil {
+                return "", err
+            }
+            m.sha256 = sum
+        }
+    }
+    if src.sha256 == "" || src.sha256 != dst.sha256 {
+        return "sha256", nil
+    }
+    return "", nil
+}
+
+
+// Plan compares local directory local with remote directory remote and
+// returns what a sync does: directories to create, then files to send,
+// then what to delete.
+func (c *Client) Plan(ctx context.Context, local, remote string, opt SyncOptions) ([]Action, error) {
+    remote = Join(remote)
+    var mkdirs, sends, rms []Action
+    lt, err := local_tree(local)
+    if errors.Is(err, fs.ErrNotExist) && opt.Direction == Pull {
+        lt, err = map[string]*fileMeta{}, nil
+        mkdirs = append(mkdirs, Action{Op: OpMkdir, Local: local})
+    }
+    if err != nil {
+        return nil, err
+    }
+    rt, err := c.remote_tree(ctx, remote, opt.Checksum)
+    if err != nil {
+        return nil, err
+    }
+    src, dst := lt, rt
+    if opt.Direction == Pull {
+        src, dst = rt, lt
+    }
+    names := make([]string, 0, len(src))
+    for rel := range src {
+        names = append(names, rel)
+    }
+    sort.Strings(names)
+
+    act := func(op, rel, reason string, size int64) Action {
+        a := Action{Op: op, Reason: reason, Size: size}
+        if op == OpPut || op == OpGet || opt.Direction == Pull {
+            a.Local = filepath.Join(local, filepath.FromSlash(rel))
+        }
+        if op == OpPut || op == OpGet || opt.Direction == Push {
+            a.Remote = Join(remote, rel)
+        }
+        return a
+    }
+    send := OpPut
+    if opt.Direction == Pull {
+        send = OpGet
+    }
+    if rt == nil && opt.Direction == Pull {
+        return nil, fmt.Errorf("%s: no such directory", remote)
+    }
+    if rt == nil {
+        mkdirs = append(mkdirs, Action{Op: OpMkdir, Remote: remote})
+    }
+    for _, rel := range names {
+        s, d := src[rel], dst[rel]
+        if d != nil && s.dir != d.dir {
+            return nil, fmt.Errorf("%s is a file on one side and a directory on the other", rel)
+        }
+        if s.dir {
+            if d == nil {
+                mkdirs = append(mkdirs, act(OpMkdir, rel, "new", 0))
+            }
+            continue
+        }
+        reason := "new"
+        if d != nil {
+            if reason, err = differ(s, d, opt.Checksum); err != nil {
+                return nil, err
+            }
+        }
+        if reason != "" {
+            sends = append(sends, act(send, rel, reason, s.size))
+        }
+    }
+    if opt.Delete {
+        var extra []string
+        for rel := range dst {
+            if src[rel] == nil {
+                extra = append(extra, rel)
+            }
+        }
+        sort.Strings(extra)
+        gone := map[string]bool{}
+        for _, rel := range extra {
+            gone[rel] = true
+            // below a directory that goes as a whole.
+            if gone[path.Dir(rel)] {
+                continue
+            }
+            rms = append(rms, act(OpRm, rel, "extraneous", 0))
+        }
+    }
+    return append(append(mkdirs, sends...), rms...), nil
+}
+
+
+type ApplyOptions struct {
+    Jobs     int // parallel transfers, at least 1
+    Progress Progress
+    // Done is called after each put or get, from the worker.
+    Done func(a Action)
+    // NoClobber makes a put fail on an existing remote file. sync plans
+    // replace files, a plain upload shouldn't.
+    NoClobber bool
+}
+
+
+// Apply runs a plan, the transfers on opt.Jobs workers. the first error
+// stops it.
+func (c *Client) Apply(ctx context.Context, plan []Action, opt ApplyOptions) error {
+    var sends []Action
+    for _, a := range plan {
+        if a.Op == OpPut || a.Op == OpGet {
+            sends = append(sends, a)
+        }
+    }
+    for _, a := range plan {
+        if a.Op != OpMkdir {
+            continue
+        }
+        var err error
+        if a.Remote != "" {
+            err = c.Mkdir(ctx, a.Remote, true)
+        } else {
+            err = os.MkdirAll(a.Local, 0777)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    if err := c.transfer(ctx, sends, opt); err != nil {
+        return err
+    }
+    for _, a := range plan {
+        if a.Op != OpRm {
+            continue
+        }
+        var err error
+        if a.Remote != "" {
+            err = c.Remove(ctx, a.Remote, true)
+        } else {
+            err = os.RemoveAll(a.Local)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+func (c *Client) transfer(ctx context.Context, sends []Action, opt ApplyOptions) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    jobs := make(chan Action)
+    var once sync.Once
+    var first error
+    var wg sync.WaitGroup
+    n := opt.Jobs
+    if n < 1 {
+        n = 1
+    }
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for a := range jobs {
+                var err error
+                if a.Op == OpPut {
+                    err = c.Upload(ctx, a.Local, a.Remote, UploadOptions{Overwrite: !opt.NoClobber, Progress: opt.Progress})
+                } else {
+                    err = c.Download(ctx, a.Remote, a.Local, DownloadOptions{Progress: opt.Progress})
+                }
+                if err == nil && opt.Done != nil {
+                    opt.Done(a)
+                }
+                if err != nil {
+                    once.Do(func() {
+                        src := a.Local
+                        if a.Op == OpGet {
+                            src = a.Remote
+                        }
+                        first = fmt.Errorf("%s: %w", src, err)
+                        cancel()
+                    })
+                }
+            }
+        }()
+    }
+feed:
+    for _, a := range sends {
+        select {
+        case jobs <- a:
+        case <-ctx.Done():
+            break feed
+        }
+    }
+    close(jobs)
+    wg.Wait()
+    if first == nil {
+        return ctx.Err()
+    }
+    return first
+}
@@ -0,0 +1,303 @@
+package main
+
+// content negotiation and compression: br, zstd, gzip.
+// auth: github.com/liikii
+
+import "compress/gzip"
+import "io"
+import "io/fs"
+import "mime"
+import "net/http"
+import "os"
+import "path"
+import "strconv"
+import "strings"
+import "sync"
+import "github.com/andybalholm/brotli"
+import "github.com/klauspost/compress/zstd"
+
+
+// files smaller than this are not worth compressing.
+const minCompressSize = 1024
+
+var compressEnabled = true
+
+// server preference, best ratio first.
+var encodings = []string{"br", "zstd", "gzip"}
+
+// precompressed sibling suffix of each encoding.
+var precompressedExt = map[string]string{
+    "br":   ".br",
+    "zstd": ".zst",
+    "gzip": ".gz",
+}
+
+
+var compressibleTypes = map[string]bool{
+    "application/javascript": true,
+    "application/json":       true,
+    "application/x-ndjson":   true,
+    "application/xml":        true,
+    "application/xhtml+xml":  true,
+    "application/x-sh":       true,
+    "application/wasm":       true,
+    "image/svg+xml":          true,
+    "image/x-icon":           true,
+}
+
+
+func compressibleType(ctype string) bool {
+    mt, _, err := mime.ParseMediaType(ctype)
+    if err != nil {
+        return false
+    }
+    return strings.HasPrefix(mt, "text/") || compressibleTypes[mt]
+}
+
+
+// acceptedEncodings parses Accept-Encoding into coding -> q.
+func acceptedEncodings(r *http.Request) map[string]float64 {
+    acc := map[string]float64{}
+    for _, v := range r.Header.Values("Accept-Encoding") {
+        for _, part := range strings.Split(v, ",") {
+            part = strings.TrimSpace(part)
+            if part == "" {
+                continue
+            }
+            q := 1.0
+            if i := strings.Index(part, ";"); i >= 0 {
+                param := strings.TrimSpace(part[i+1:])
+                part = strings.TrimSpace(part[:i])
+                if strings.HasPrefix(param, "q=") {
+                    if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+                        q = f
+                    }
+                }
+            }
+            acc[strings.ToLower(part)] = q
+        }
+    }
+    return acc
+}
+
+
+// negotiateEncoding picks an encoding out of offers, "" is identity.
+func negotiateEncoding(r *http.Request, offers []string) string {
+    if !compressEnabled {
+        return ""
+    }
+    acc := acceptedEncodings(r)
+    best, bestQ := "", 0.0
+    for _, e := range offers {
+        q, ok := acc[e]
+        if !ok {
+            q, ok = acc["*"]
+        }
+        if ok && q > bestQ {
+            best, bestQ = e, q
+        }
+    }
+    return best
+}
+
+
+var gzipPool = sync.Pool{New: func() interface{} {
+    zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+    return zw
+}}
+
+
+type gzipEncoder struct {
+    *gzip.Writer
+}
+
+
+func (g gzipEncoder) Close() error {
+    err := g.Writer.Close()
+    gzipPool.Put(g.Writer)
+    return err
+}
+
+
+type encoder interface {
+    io.WriteCloser
+    Flush() error
+}
+
+
+func newEncoder(enc string, w io.Writer) encoder {
+    switch enc {
+    case "br":
+        return brotli.NewWriterLevel(w, 4)
+    case "zstd":
+        zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+        if err != nil {
+            return nil
+        }
+        return zw
+    case "gzip":
+        zw := gzipPool.Get().(*gzip.Writer)
+        zw.Reset(w)
+        return gzipEncoder{zw}
+    }
+    return nil
+}
+
+
+// releaseEncoder drops an encoder nothing was written to.
+func releaseEncoder(e encoder) {
+    if g, ok := e.(gzipEncoder); ok {
+        gzipPool.Put(g.Writer)
+    }
+}
+
+
+func addVary(h http.Header, v string) {
+    for _, s := range h.Values("Vary") {
+        for _, f := range strings.Split(s, ",") {
+            if strings.EqualFold(strings.TrimSpace(f), v) {
+                return
+            }
+        }
+    }
+    h.Add("Vary", v)
+}
+
+
+// encodedEtag marks an etag as belonging to an encoded representation.
+func encodedEtag(etag, enc string) string {
+    if etag == "" {
+        return ""
+    }
+    return strings.TrimSuffix(etag, `"`) + "-" + enc + `"`
+}
+
+
+// compressResponseWriter compresses a dynamic response when its
+// Content-Type is compressible and the client accepts an encoding.
+type compressResponseWriter struct {
+    http.ResponseWriter
+    r           *http.Request
+    enc         encoder
+    wroteHeader bool
+}
+
+
+func (cw *compressResponseWriter) WriteHeader(code int) {
+    if cw.wroteHeader {
+        return
+    }
+    cw.wroteHeader = true
+    h := cw.Header()
+    if code >= 200 && code != 204 && code != 304 && h.Get("Content-Encoding") == "" &&
+        compressibleType(h.Get("Content-Type")) {
+        addVary(h, "Accept-Encoding")
+        if e := negotiateEncoding(cw.r, encodings); e != "" {
+            cw.enc = newEncoder(e, cw.ResponseWriter)
+            if cw.enc != nil {
+                h.Set("Content-Encoding", e)
+                h.Del("Content-Length")
+                if etag := h.Get("Etag"); etag != "" {
+                    h.Set("Etag", encodedEtag(etag, e))
+                }
+            }
+        }
+    }
+    cw.ResponseWriter.WriteHeader(code)
+}
+
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+    if !cw.wroteHeader {
+        cw.WriteHeader(200)
+    }
+    if cw.enc != nil {
+        return cw.enc.Write(b)
+    }
+    return cw.ResponseWriter.Write(b)
+}
+
+
+func (cw *compressResponseWriter) Flush() {
+    if cw.enc != nil {
+        cw.enc.Flush()
+    }
+    if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+    return cw.ResponseWriter
+}
+
+
+func (cw *compressResponseWriter) Close() error {
+    if cw.enc != nil {
+        return cw.enc.Close()
+    }
+    return nil
+}
+
+
+// compressDynamic wraps w for a generated response, call done when finished.
+// the Content-Type must be set before the first write.
+func compressDynamic(w http.ResponseWriter, r *http.Request) (cw http.ResponseWriter, done func()) {
+    c := &compressResponseWriter{ResponseWriter: w, r: r}
+    return c, func() { c.Close() }
+}
+
+
+// openPrecompressed finds a foo.br / foo.zst / foo.gz sibling of name
+// that is not older than the original, in the client's preferred encoding.
+func openPrecompressed(fsys FileSystem, r *http.Request, name string, orig os.FileInfo) (http.File, os.FileInfo, string) {
+    if !compressEnabled || r.Header.Get("Accept-Encoding") == "" {
+        return nil, nil, ""
+    }
+    acc := acceptedEncodings(r)
+    for _, e := range encodings {
+        if q, ok := acc[e]; !ok || q <= 0 {
+            continue
+        }
+        f, err := open_precompressed(fsys, name+precompressedExt[e])
+        if err != nil {
+            continue
+        }
+        d, err := f.Stat()
+        if err != nil || !d.Mode().IsRegular() || d.ModTime().Before(orig.ModTime()) {
+            f.Close()
+            continue
+        }
+        return f, d, e
+    }
+    return nil, nil, ""
+}
+
+
+// open_precompressed opens sibling name like serveFile would the file:
+// Dir.Open applies the symlink policy, a hidden sibling is not there.
+func open_precompressed(fsys FileSystem, name string) (http.File, error) {
+    if osPath(fsys, name) != "" && !newHideChecker().fetchable(name, false) {
+        return nil, fs.ErrNotExist
+    }
+    return fsys.Open(name)
+}
+
+
+// hasPrecompressed reports whether any sibling exists, the response
+// then varies on Accept-Encoding even when identity is served.
+func hasPrecompressed(fsys FileSystem, name string) bool {
+    for _, ext := range precompressedExt {
+        if f, err := open_precompressed(fsys, name+ext); err == nil {
+            f.Close()
+            return true
+        }
+    }
+    return false
+}
+
+
+func typeByName(name string) string {
+    return mime.TypeByExtension(path.Ext(name))
+}
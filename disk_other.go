@@ -0,0 +1,19 @@
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// disk usage and permission checks, other systems.
+// auth: github.com/liikii
+
+import "os"
+
+
+func diskUsage(path string) (total, free uint64, ok bool) {
+    return 0, 0, false
+}
+
+
+func dirWritable(path string) bool {
+    fi, err := os.Stat(path)
+    return err == nil && fi.IsDir() && fi.Mode().Perm()&0200 != 0
+}
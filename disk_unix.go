@@ -0,0 +1,25 @@
+// +build linux darwin freebsd
+
+package main
+
+// disk usage and permission checks, unix.
+// auth: github.com/liikii
+
+import "syscall"
+
+
+func diskUsage(path string) (total, free uint64, ok bool) {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(path, &st); err != nil {
+        return 0, 0, false
+    }
+    bs := uint64(st.Bsize)
+    return uint64(st.Blocks) * bs, uint64(st.Bavail) * bs, true
+}
+
+
+// dirWritable asks the kernel, so ownership, groups and acls count.
+func dirWritable(path string) bool {
+    const W_OK = 2
+    return syscall.Access(path, W_OK) == nil
+}
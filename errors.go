@@ -0,0 +1,133 @@
+package main
+
+// http errors: status mapping, html pages, json bodies and request ids.
+// auth: github.com/liikii
+
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "html/template"
+import "io/fs"
+import "net/http"
+import "regexp"
+import "strings"
+import "github.com/google/uuid"
+
+
+var errInvalidPath = errors.New("http: invalid character in file path")
+
+// error.html of the static assets, parsed once in main.
+var errorTmpl *template.Template
+
+
+type ctxKey int
+
+const requestIDKey ctxKey = 0
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+
+// withRequestID takes a sane X-Request-Id from a proxy, or makes one.
+func withRequestID(r *http.Request) *http.Request {
+    id := r.Header.Get("X-Request-Id")
+    if !validRequestID.MatchString(id) {
+        id = strings.ReplaceAll(uuid.New().String(), "-", "")
+    }
+    return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+
+func requestID(r *http.Request) string {
+    id, _ := r.Context().Value(requestIDKey).(string)
+    return id
+}
+
+
+func toHTTPError(err error) (msg string, httpStatus int) {
+    if errors.Is(err, fs.ErrNotExist) {
+        return "404 page not found", http.StatusNotFound
+    }
+    if errors.Is(err, fs.ErrPermission) {
+        return "403 Forbidden", http.StatusForbidden
+    }
+    if errors.Is(err, errInvalidPath) {
+        return "400 Bad Request", http.StatusBadRequest
+    }
+    // Default:
+    return "500 Internal Server Error", StatusInternalServerError
+}
+
+
+type errorPage struct {
+    Code      int    `json:"code"`
+    Status    string `json:"status"`
+    Message   string `json:"message"`
+    RequestID string `json:"request_id"`
+}
+
+
+func wantsJSON(r *http.Request) bool {
+    if strings.HasPrefix(r.URL.Path, reservedPrefix+"/api/") {
+        return true
+    }
+    accept := r.Header.Get("Accept")
+    return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+
+func wantsHTML(r *http.Request) bool {
+    return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+
+// serveError replies with an html page for browsers, json for api
+// clients and plain text otherwise. all carry the request id.
+func serveError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+    p := errorPage{Code: code, Status: http.StatusText(code), Message: msg, RequestID: requestID(r)}
+    h := w.Header()
+    h.Del("Content-Length")
+    h.Del("Content-Encoding")
+    h.Del("Etag")
+    h.Del("Last-Modified")
+    h.Set("X-Content-Type-Options", "nosniff")
+    h.Set("Cache-Control", "no-store")
+
+    switch {
+    case wantsJSON(r):
+        h.Set("Content-Type", "application/json")
+        w.WriteHeader(code)
+        json.NewEncoder(w).Encode(p)
+    case wantsHTML(r) && errorTmpl != nil:
+        h.Set("Content-Type", "text/html; charset=utf-8")
+        w.WriteHeader(code)
+        if err := errorTmpl.Execute(w, p); err != nil {
+            fmt.Fprintf(w, "%d %s", code, htmlEscape(msg))
+        }
+    default:
+        h.Set("Content-Type", "text/plain; charset=utf-8")
+        w.WriteHeader(code)
+        fmt.Fprintf(w, "%s\nrequest id: %s\n", msg, p.RequestID)
+    }
+}
+
+
+// httpError maps err to a status and serves the error.
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
+    msg, code := toHTTPError(err)
+    serveError(w, r, code, msg)
+}
+
+
+func load_error_template() error {
+    b, err := fs.ReadFile(assets, "error.html")
+    if err != nil {
+        return err
+    }
+    t, err := template.New("error.html").Funcs(templateFuncs).Parse(string(b))
+    if err != nil {
+        return err
+    }
+    errorTmpl = t
+    return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+// live changes of a directory as server-sent events.
+// auth: github.com/liikii
+
+import "encoding/json"
+import "fmt"
+import "io/fs"
+import "net/http"
+import "path"
+import "strings"
+import "time"
+
+
+const (
+    // changes of one path within this window go out as one event.
+    eventCoalesce  = 250 * time.Millisecond
+    eventKeepAlive = 25 * time.Second
+    // events queued for a slow client, past that it gets a reset.
+    eventQueue     = 1024
+)
+
+
+// liveEvent is the data of an event. Type, Size and MTime are absent
+// for removals.
+type liveEvent struct {
+    Op      string     `json:"op"` // create, write, remove or reset
+    Path    string     `json:"path"`
+    Type    string     `json:"type,omitempty"`
+    Size    int64      `json:"size,omitempty"`
+    ModTime *time.Time `json:"mtime,omitempty"`
+}
+
+
+// eventScope: which changes a stream reports.
+type eventScope struct {
+    rel       string // slash, relative to the share
+    dir       bool   // rel is a directory, report its entries
+    recursive bool   // and everything below
+}
+
+
+func (sc *eventScope) match(rel string) bool {
+    if rel == sc.rel {
+        return true
+    }
+    if !sc.dir {
+        return false
+    }
+    if sc.recursive {
+        return sc.rel == "" || strings.HasPrefix(rel, sc.rel+"/")
+    }
+    parent := path.Dir(rel)
+    if parent == "." {
+        parent = ""
+    }
+    return parent == sc.rel
+}
+
+
+// events_api streams create, write and remove events of the entries of
+// a directory, or of one path, which need not exist yet. the first
+// event, ready, carries the stat of the path once the watch is set up.
+//   curl -N 'http://127.0.0.1:9898/_/api/v1/events?path=/docs/'
+func events_api(w http.ResponseWriter, r *http.Request) {
+    upath, err := apiPath(r.URL.Query().Get("path"))
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    sc := &eventScope{rel: strings.TrimPrefix(upath, "/"), recursive: boolParam(r, "recursive")}
+    if fi, err := lookup(upath); err == nil {
+        sc.dir = fi.IsDir()
+    } else if fi, err := lookup(path.Dir(upath)); err != nil || !fi.IsDir() {
+        // waiting for a path is fine, its directory must be there.
+        if err == nil {
+            err = fs.ErrNotExist
+        }
+        httpError(w, r, err)
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        serveError(w, r, 500, "streaming not supported")
+        return
+    }
+    tw, err := watchShare()
+    if err != nil {
+        serveError(w, r, 503, "watching the share is not available: "+err.Error())
+        return
+    }
+
+    ch := make(chan fsEvent, eventQueue)
+    overflow := make(chan struct{}, 1)
+    cancel := tw.subscribe(func(ev fsEvent) {
+        if !sc.match(ev.Path) {
+            return
+        }
+        select {
+        case ch <- ev:
+        default:
+            select {
+            case overflow <- struct{}{}:
+            default:
+            }
+        }
+    })
+    defer cancel()
+    mEventStreams.Add(1)
+    defer mEventStreams.Add(-1)
+
+    h := w.Header()
+    h.Set("Content-Type", "text/event-stream")
+    h.Set("Cache-Control", "no-store")
+    h.Set("X-Accel-Buffering", "no")
+    w.WriteHeader(200)
+
+    id := 0
+    send := func(name string, v interface{}) bool {
+        b, _ := json.Marshal(v)
+        id++
+        _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, name, b)
+        flusher.Flush()
+        return err == nil
+    }
+    if !send("ready", stat_path(upath)) {
+        return
+    }
+
+    // pending changes by path, in the order they came.
+    var order []string
+    pending := map[string]string{}
+    flush := func() bool {
+        hc := newHideChecker()
+        for _, rel := range order {
+            if !send_event(send, hc, rel, pending[rel]) {
+                return false
+            }
+        }
+        order, pending = order[:0], map[string]string{}
+        return true
+    }
+    tick := time.NewTicker(eventCoalesce)
+    defer tick.Stop()
+    alive := time.NewTicker(eventKeepAlive)
+    defer alive.Stop()
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case ev := <-ch:
+            op, seen := pending[ev.Path]
+            if !seen {
+                order = append(order, ev.Path)
+            }
+            // a file created and then written is still new.
+            if !(op == evCreate && ev.Op == evWrite) {
+                pending[ev.Path] = ev.Op
+            }
+        case <-overflow:
+            // events were lost, the client has to look again.
+            order, pending = order[:0], map[string]string{}
+            for len(ch) > 0 {
+                <-ch
+            }
+            if !send("reset", liveEvent{Op: "reset", Path: upath}) {
+                return
+            }
+        case <-tick.C:
+            if len(order) > 0 && !flush() {
+                return
+            }
+        case <-alive.C:
+            if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        }
+    }
+}
+
+
+// send_event describes rel as it is now. hidden paths are left out,
+// and so are creates of files gone again.
+func send_event(send func(string, interface{}) bool, hc *hideChecker, rel, op string) bool {
+    le := liveEvent{Op: op, Path: "/" + rel}
+    if op == evRemove {
+        if hc.hidden(rel, false) {
+            return true
+        }
+        return send(op, le)
+    }
+    fi, err := lookup(le.Path)
+    if err != nil {
+        return true
+    }
+    le.Type, le.Size = "file", fi.Size()
+    if fi.IsDir() {
+        le.Type, le.Size = "dir", 0
+    }
+    mt := fi.ModTime().UTC()
+    le.ModTime = &mt
+    return send(op, le)
+}
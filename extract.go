@@ -0,0 +1,391 @@
+package main
+
+// unpacking uploaded zip, tar and tar.gz archives, ?extract=1.
+// auth: github.com/liikii
+
+import "archive/tar"
+import "archive/zip"
+import "bufio"
+import "bytes"
+import "compress/gzip"
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "io"
+import "io/fs"
+import "log"
+import "net/http"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+
+
+// -extractmaxsize and -extractmaxfiles bound what one archive may unpack
+// to, whatever its headers claim, -extractmaxarchive the archive itself.
+var extractMaxSize int64 = 4 << 30
+var extractMaxFiles = 10000
+var extractMaxArchive int64 = 4 << 30
+
+var errNotArchive = errors.New("not a zip, tar or tar.gz archive")
+
+
+// archiveError is a refused archive, answered with Code.
+type archiveError struct {
+    Code int
+    Msg  string
+}
+
+
+func (e *archiveError) Error() string { return e.Msg }
+
+
+type archiveSkip struct {
+    Name   string `json:"name"`
+    Reason string `json:"reason"` // symlink, special or hidden
+}
+
+
+// archiveResult: Files and Dirs are the url paths written, Name the
+// upload the archive came as.
+type archiveResult struct {
+    Name    string        `json:"name,omitempty"`
+    Format  string        `json:"format"` // zip, tar or tar.gz
+    Dir     string        `json:"dir"`
+    Files   []string      `json:"files"`
+    Dirs    []string      `json:"dirs"`
+    Size    int64         `json:"size"` // bytes unpacked
+    Skipped []archiveSkip `json:"skipped,omitempty"`
+}
+
+
+// archiveEntry is one member, typ is 'f'ile, 'd'ir, 'l'ink or 'o'ther.
+type archiveEntry struct {
+    name  string
+    typ   byte
+    size  int64
+    mtime time.Time
+}
+
+
+// archive_format sniffs ra: zip, tar.gz or tar, "" for anything else.
+func archive_format(ra io.ReaderAt) string {
+    var head [512]byte
+    n, _ := ra.ReadAt(head[:], 0)
+    b := head[:n]
+    switch {
+    case bytes.HasPrefix(b, []byte("PK\x03\x04")), bytes.HasPrefix(b, []byte("PK\x05\x06")):
+        return "zip"
+    case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
+        return "tar.gz"
+    case n >= 262 && bytes.HasPrefix(b[257:], []byte("ustar")):
+        return "tar"
+    }
+    return ""
+}
+
+
+// walk_archive calls fn for every member, r reads a file member.
+func walk_archive(ra io.ReaderAt, size int64, format string, fn func(e *archiveEntry, r io.Reader) error) error {
+    if format == "zip" {
+        zr, err := zip.NewReader(ra, size)
+        if err != nil {
+            return &archiveError{400, "bad zip: " + err.Error()}
+        }
+        for _, f := range zr.File {
+            e := &archiveEntry{name: f.Name, typ: 'f', size: int64(f.UncompressedSize64), mtime: f.Modified}
+            mode := f.Mode()
+            switch {
+            case mode&fs.ModeSymlink != 0:
+                e.typ = 'l'
+            case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+                e.typ, e.size = 'd', 0
+            case !mode.IsRegular():
+                e.typ = 'o'
+            }
+            var r io.ReadCloser
+            if e.typ == 'f' {
+                if r, err = f.Open(); err != nil {
+                    return &archiveError{400, "bad zip: " + err.Error()}
+                }
+            }
+            err := fn(e, r)
+            if r != nil {
+                r.Close()
+            }
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    var src io.Reader = io.NewSectionReader(ra, 0, size)
+    if format == "tar.gz" {
+        gz, err := gzip.NewReader(src)
+        if err != nil {
+            return &archiveError{400, "bad gzip: " + err.Error()}
+        }
+        defer gz.Close()
+        src = gz
+    }
+    tr := tar.NewReader(src)
+    for {
+        h, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return &archiveError{400, "bad tar: " + err.Error()}
+        }
+        e := &archiveEntry{name: h.Name, typ: 'o', size: h.Size, mtime: h.ModTime}
+        switch h.Typeflag {
+        case tar.TypeReg, tar.TypeRegA:
+            e.typ = 'f'
+        case tar.TypeDir:
+            e.typ, e.size = 'd', 0
+        case tar.TypeSymlink, tar.TypeLink:
+            e.typ = 'l'
+        }
+        if err := fn(e, tr); err != nil {
+            return err
+        }
+    }
+}
+
+
+// budgetReader fails once more than left bytes went through, whatever
+// the headers said.
+type budgetReader struct {
+    r    io.Reader
+    left *int64
+}
+
+
+func (b budgetReader) Read(p []byte) (int, error) {
+    n, err := b.r.Read(p)
+    if err != nil && err != io.EOF {
+        // a damaged archive, not a failing disk.
+        err = &archiveError{400, "bad archive: " + err.Error()}
+    }
+    *b.left -= int64(n)
+    if *b.left < 0 {
+        return n, &archiveError{413, fmt.Sprintf("archive unpacks to more than %d bytes", extractMaxSize)}
+    }
+    return n, err
+}
+
+
+// extract_archive unpacks ra, an archive of size bytes called name, into
+// the directory dir. a first pass checks every member: paths must stay
+// inside dir, the count and the declared sizes within the limits, and
+// nothing may be in the way unless overwrite. links and special files
+// are skipped. if writing fails what was created is removed again.
+func extract_archive(r *http.Request, ra io.ReaderAt, size int64, name, dir string, overwrite bool) (*archiveResult, error) {
+    format := archive_format(ra)
+    if format == "" {
+        return nil, errNotArchive
+    }
+    res := &archiveResult{Name: name, Format: format, Dir: dir, Files: []string{}, Dirs: []string{}}
+    hc := newHideChecker()
+    count := 0
+    var declared int64
+    target := func(e *archiveEntry) (string, error) {
+        if e.typ == 'd' && strings.Trim(e.name, "./") == "" {
+            // "./" of tar -C dir ., dir itself.
+            return "", nil
+        }
+        rel, err := clean_upload_name(e.name)
+        if err != nil {
+            return "", &archiveError{400, "unsafe path in archive: " + e.name}
+        }
+        return path.Join(dir, rel), nil
+    }
+    skip := func(e *archiveEntry, t string) string {
+        switch {
+        case e.typ == 'l':
+            return "symlink"
+        case e.typ == 'o':
+            return "special"
+        case hc.hidden(strings.TrimPrefix(t, "/"), e.typ == 'd'):
+            return "hidden"
+        }
+        return ""
+    }
+
+    err := walk_archive(ra, size, format, func(e *archiveEntry, _ io.Reader) error {
+        t, err := target(e)
+        if err != nil || t == "" {
+            return err
+        }
+        // skipped members count too, a tar has to be read through them.
+        count++
+        declared += e.size
+        if count > extractMaxFiles {
+            return &archiveError{413, fmt.Sprintf("archive has more than %d entries", extractMaxFiles)}
+        }
+        if declared > extractMaxSize {
+            return &archiveError{413, fmt.Sprintf("archive unpacks to more than %d bytes", extractMaxSize)}
+        }
+        if why := skip(e, t); why != "" {
+            res.Skipped = append(res.Skipped, archiveSkip{Name: e.name, Reason: why})
+            return nil
+        }
+        mode, err := lstat_in_root(strings.TrimPrefix(t, "/"))
+        if err != nil {
+            return nil
+        }
+        if (e.typ == 'd' && !mode.IsDir()) || (e.typ == 'f' && (mode.IsDir() || !overwrite)) {
+            return &fs.PathError{Op: "extract", Path: t, Err: fs.ErrExist}
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // files and directories that are new, to remove them again on failure.
+    var created, made []string
+    mkdirs := func(d string) error {
+        var missing []string
+        for p := d; p != dir && p != "/"; p = path.Dir(p) {
+            if _, err := lstat_in_root(strings.TrimPrefix(p, "/")); err != nil {
+                missing = append(missing, p)
+            }
+        }
+        if err := make_dirs(d); err != nil {
+            return err
+        }
+        made = append(made, missing...)
+        return nil
+    }
+    left := extractMaxSize
+    err = walk_archive(ra, size, format, func(e *archiveEntry, body io.Reader) error {
+        t, err := target(e)
+        if err != nil || t == "" || skip(e, t) != "" {
+            return err
+        }
+        if e.typ == 'd' {
+            if err := mkdirs(t); err != nil {
+                return err
+            }
+            res.Dirs = append(res.Dirs, t)
+            return nil
+        }
+        if err := mkdirs(path.Dir(t)); err != nil {
+            return err
+        }
+        _, lerr := lstat_in_root(strings.TrimPrefix(t, "/"))
+        n, err := save_file(r, t, budgetReader{body, &left}, overwrite)
+        if err != nil {
+            return err
+        }
+        if lerr != nil {
+            created = append(created, t)
+        }
+        res.Files = append(res.Files, t)
+        res.Size += n
+        if !e.mtime.IsZero() {
+            os.Chtimes(filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(t, "/"))), time.Now(), e.mtime)
+        }
+        return nil
+    })
+    if err != nil {
+        // new files first, then the new directories, deepest first.
+        for _, f := range created {
+            remove_in_root(strings.TrimPrefix(f, "/"), false)
+        }
+        sort.Sort(sort.Reverse(sort.StringSlice(made)))
+        for _, d := range made {
+            remove_in_root(strings.TrimPrefix(d, "/"), false)
+        }
+        return nil, err
+    }
+    return res, nil
+}
+
+
+func archive_too_large() error {
+    return &archiveError{413, fmt.Sprintf("archive larger than %d bytes", extractMaxArchive)}
+}
+
+
+// spool_upload stores body in a hidden temporary file in the directory
+// dir of the share, archives need random access. at most
+// -extractmaxarchive bytes are written.
+func spool_upload(dir string, body io.Reader) (*os.File, int64, func(), error) {
+    var rnd [8]byte
+    rand.Read(rnd[:])
+    tmp := path.Join(strings.TrimPrefix(dir, "/"), tempPrefix+"extract-"+hex.EncodeToString(rnd[:]))
+    f, err := create_in_root(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return nil, 0, nil, err
+    }
+    cleanup := func() {
+        f.Close()
+        remove_in_root(tmp, false)
+    }
+    n, err := io.Copy(f, io.LimitReader(body, extractMaxArchive+1))
+    if err == nil && n > extractMaxArchive {
+        err = archive_too_large()
+    }
+    if err != nil {
+        cleanup()
+        return nil, 0, nil, err
+    }
+    return f, n, cleanup, nil
+}
+
+
+// is_archive tells from the first bytes of br if it is an archive.
+func is_archive(br *bufio.Reader) bool {
+    head, _ := br.Peek(512)
+    return archive_format(bytes.NewReader(head)) != ""
+}
+
+
+// extract_upload unpacks the archive body, called name, into dir.
+func extract_upload(r *http.Request, body io.Reader, name, dir string, overwrite bool) (*archiveResult, error) {
+    f, n, cleanup, err := spool_upload(dir, body)
+    if err != nil {
+        return nil, err
+    }
+    defer cleanup()
+    return extract_archive(r, f, n, name, dir, overwrite)
+}
+
+
+// put_archive unpacks the request body into directory upath, PUT
+// /_/api/v1/files with extract=1.
+//   curl -T site.zip 'http://127.0.0.1:9898/_/api/v1/files?path=/www/&extract=1'
+func put_archive(w http.ResponseWriter, r *http.Request, upath string) {
+    rel := strings.TrimPrefix(upath, "/")
+    if !dir_in_root(rel) || newHideChecker().hidden(rel, true) {
+        serveError(w, r, 404, "no such directory")
+        return
+    }
+    ar, err := extract_upload(r, r.Body, "", upath, boolParam(r, "overwrite"))
+    if err != nil {
+        log.Printf("api extract into %s: %v", upath, err)
+        extractFail(w, r, err)
+        return
+    }
+    writeJSON(w, 201, ar)
+}
+
+
+// extractFail answers the errors of extract_archive.
+func extractFail(w http.ResponseWriter, r *http.Request, err error) {
+    mUploadFailures.Inc("extract")
+    var ae *archiveError
+    switch {
+    case errors.As(err, &ae):
+        serveError(w, r, ae.Code, ae.Msg)
+    case errors.Is(err, errNotArchive):
+        serveError(w, r, 400, err.Error())
+    default:
+        apiFail(w, r, err)
+    }
+}
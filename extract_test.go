@@ -0,0 +1,297 @@
+package main
+
+// auth: github.com/liikii
+
+import "archive/tar"
+import "archive/zip"
+import "bytes"
+import "compress/gzip"
+import "encoding/binary"
+import "encoding/json"
+import "io/fs"
+import "mime/multipart"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+
+// member of a test archive, a symlink to link when link is set.
+type member struct {
+    name string
+    body string
+    link string
+}
+
+
+func zip_of(t *testing.T, ms ...member) []byte {
+    var buf bytes.Buffer
+    zw := zip.NewWriter(&buf)
+    for _, m := range ms {
+        h := &zip.FileHeader{Name: m.name, Method: zip.Store}
+        body := m.body
+        if m.link != "" {
+            h.SetMode(fs.ModeSymlink | 0777)
+            body = m.link
+        }
+        w, err := zw.CreateHeader(h)
+        if err != nil {
+            t.Fatal(err)
+        }
+        w.Write([]byte(body))
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+
+func tar_of(t *testing.T, gz bool, ms ...member) []byte {
+    var buf bytes.Buffer
+    var gw *gzip.Writer
+    tw := tar.NewWriter(&buf)
+    if gz {
+        gw = gzip.NewWriter(&buf)
+        tw = tar.NewWriter(gw)
+    }
+    for _, m := range ms {
+        h := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.body)), Typeflag: tar.TypeReg}
+        if m.link != "" {
+            h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, m.link, 0
+        }
+        if err := tw.WriteHeader(h); err != nil {
+            t.Fatal(err)
+        }
+        tw.Write([]byte(m.body))
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if gz {
+        gw.Close()
+    }
+    return buf.Bytes()
+}
+
+
+// extract_setup shares a temporary directory with an empty /in, the
+// limits are put back after the test.
+func extract_setup(t *testing.T) {
+    oldDst, oldRoot := dst, realRoot
+    oldSize, oldFiles, oldArchive := extractMaxSize, extractMaxFiles, extractMaxArchive
+    t.Cleanup(func() {
+        dst, realRoot = oldDst, oldRoot
+        extractMaxSize, extractMaxFiles, extractMaxArchive = oldSize, oldFiles, oldArchive
+    })
+    dst = t.TempDir()
+    if err := init_real_root(); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Mkdir(filepath.Join(dst, "in"), 0755); err != nil {
+        t.Fatal(err)
+    }
+}
+
+
+func put_extract(t *testing.T, body []byte) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("PUT", apiPrefix+"/files?path=/in/&extract=1", bytes.NewReader(body))
+    w := httptest.NewRecorder()
+    put_archive(w, r, "/in/")
+    return w
+}
+
+
+// tree lists everything in the share, directories end in / and links
+// in @, so that a write outside /in or through a link shows.
+func tree(t *testing.T) []string {
+    var got []string
+    filepath.WalkDir(dst, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            t.Fatal(err)
+        }
+        rel, _ := filepath.Rel(dst, p)
+        switch {
+        case rel == ".":
+        case d.Type()&fs.ModeSymlink != 0:
+            got = append(got, filepath.ToSlash(rel)+"@")
+        case d.IsDir():
+            got = append(got, filepath.ToSlash(rel)+"/")
+        default:
+            got = append(got, filepath.ToSlash(rel))
+        }
+        return nil
+    })
+    return got
+}
+
+
+func want_tree(t *testing.T, want ...string) {
+    if got := tree(t); !reflect.DeepEqual(got, want) {
+        t.Errorf("share holds %q, want %q", got, want)
+    }
+}
+
+
+func TestExtractFormats(t *testing.T) {
+    ms := []member{{name: "a.txt", body: "a"}, {name: "d/b.txt", body: "b"}}
+    for name, ar := range map[string][]byte{
+        "zip":    zip_of(t, ms...),
+        "tar":    tar_of(t, false, ms...),
+        "tar.gz": tar_of(t, true, ms...),
+    } {
+        t.Run(name, func(t *testing.T) {
+            extract_setup(t)
+            w := put_extract(t, ar)
+            if w.Code != 201 {
+                t.Fatalf("%d %s", w.Code, w.Body)
+            }
+            var res archiveResult
+            if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+                t.Fatal(err)
+            }
+            if res.Format != name || !reflect.DeepEqual(res.Files, []string{"/in/a.txt", "/in/d/b.txt"}) {
+                t.Errorf("%+v", res)
+            }
+            want_tree(t, "in/", "in/a.txt", "in/d/", "in/d/b.txt")
+        })
+    }
+}
+
+
+func TestExtractUnsafePaths(t *testing.T) {
+    for _, name := range []string{"../evil.txt", "/evil.txt", "d/../../evil.txt", "d/../../../evil.txt"} {
+        ms := []member{{name: "ok.txt", body: "ok"}, {name: name, body: "evil"}}
+        for kind, ar := range map[string][]byte{"zip": zip_of(t, ms...), "tar": tar_of(t, false, ms...)} {
+            t.Run(kind+" "+name, func(t *testing.T) {
+                extract_setup(t)
+                if w := put_extract(t, ar); w.Code != 400 {
+                    t.Fatalf("%d %s", w.Code, w.Body)
+                }
+                // refused before anything is written.
+                want_tree(t, "in/")
+            })
+        }
+    }
+}
+
+
+func TestExtractSkipsLinksAndHidden(t *testing.T) {
+    ms := []member{
+        {name: "link", link: "/"},
+        {name: "link/x.txt", body: "x"},
+        {name: "up", link: "../.."},
+        {name: ".git/config", body: "[core]"},
+    }
+    for kind, ar := range map[string][]byte{"zip": zip_of(t, ms...), "tar": tar_of(t, false, ms...)} {
+        t.Run(kind, func(t *testing.T) {
+            extract_setup(t)
+            w := put_extract(t, ar)
+            if w.Code != 201 {
+                t.Fatalf("%d %s", w.Code, w.Body)
+            }
+            var res archiveResult
+            if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+                t.Fatal(err)
+            }
+            want := []archiveSkip{{"link", "symlink"}, {"up", "symlink"}, {".git/config", "hidden"}}
+            if !reflect.DeepEqual(res.Skipped, want) {
+                t.Errorf("skipped %+v", res.Skipped)
+            }
+            // link/ is a new directory, not the link.
+            want_tree(t, "in/", "in/link/", "in/link/x.txt")
+        })
+    }
+}
+
+
+func TestExtractLimits(t *testing.T) {
+    three := []member{{name: "a", body: "a"}, {name: "b", body: "b"}, {name: "c", body: "c"}}
+    big := []member{{name: "big", body: strings.Repeat("x", 1000)}}
+    for _, tc := range []struct {
+        name  string
+        ar    []byte
+        limit func()
+    }{
+        {"files", zip_of(t, three...), func() { extractMaxFiles = 2 }},
+        {"files tar", tar_of(t, false, three...), func() { extractMaxFiles = 2 }},
+        {"size", zip_of(t, big...), func() { extractMaxSize = 100 }},
+        {"size tar.gz", tar_of(t, true, big...), func() { extractMaxSize = 100 }},
+        {"archive", tar_of(t, false, big...), func() { extractMaxArchive = 512 }},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            extract_setup(t)
+            tc.limit()
+            if w := put_extract(t, tc.ar); w.Code != 413 {
+                t.Fatalf("%d %s", w.Code, w.Body)
+            }
+            // the spooled archive is gone too.
+            want_tree(t, "in/")
+        })
+    }
+}
+
+
+// a zip whose second file is larger than its header says passes the
+// first pass, and fails once the first file and d/ are written.
+func TestExtractRollback(t *testing.T) {
+    extract_setup(t)
+    ar := zip_of(t, member{name: "a.txt", body: "a"}, member{name: "d/b.txt", body: strings.Repeat("b", 100)})
+    cd := bytes.LastIndex(ar, []byte("PK\x01\x02"))
+    binary.LittleEndian.PutUint32(ar[cd+24:], 1) // uncompressed size
+    w := put_extract(t, ar)
+    if w.Code != 400 {
+        t.Fatalf("%d %s", w.Code, w.Body)
+    }
+    want_tree(t, "in/")
+}
+
+
+func TestExtractKeepsExisting(t *testing.T) {
+    extract_setup(t)
+    if err := os.WriteFile(filepath.Join(dst, "in", "a.txt"), []byte("mine"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    ar := zip_of(t, member{name: "new.txt", body: "n"}, member{name: "a.txt", body: "theirs"})
+    if w := put_extract(t, ar); w.Code != 409 {
+        t.Fatalf("%d %s", w.Code, w.Body)
+    }
+    if b, _ := os.ReadFile(filepath.Join(dst, "in", "a.txt")); string(b) != "mine" {
+        t.Errorf("a.txt is %q", b)
+    }
+    want_tree(t, "in/", "in/a.txt")
+}
+
+
+// the page's /upload lists the plain files written next to the
+// archives unpacked.
+func TestUploadExtractListsFiles(t *testing.T) {
+    extract_setup(t)
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    fw, _ := mw.CreateFormFile("files", "site.zip")
+    fw.Write(zip_of(t, member{name: "index.html", body: "<p>"}))
+    fw, _ = mw.CreateFormFile("files", "notes.txt")
+    fw.Write([]byte("notes"))
+    mw.Close()
+    r := httptest.NewRequest("POST", "/upload?a=in&extract=1", &body)
+    r.Header.Set("Content-Type", mw.FormDataContentType())
+    w := httptest.NewRecorder()
+    upload(w, r)
+    if w.Code != 200 {
+        t.Fatalf("%d %s", w.Code, w.Body)
+    }
+    var res uploadResult
+    if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+        t.Fatal(err)
+    }
+    if len(res.Files) != 1 || res.Files[0].Path != "/in/notes.txt" {
+        t.Errorf("files %+v", res.Files)
+    }
+    if len(res.Archives) != 1 || !reflect.DeepEqual(res.Archives[0].Files, []string{"/in/index.html"}) {
+        t.Errorf("archives %+v", res.Archives)
+    }
+    want_tree(t, "in/", "in/index.html", "in/notes.txt")
+}
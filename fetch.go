@@ -0,0 +1,413 @@
+package main
+
+// fetching a url into the share in the background, /_/api/v1/fetch.
+// auth: github.com/liikii
+
+import "context"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "hash"
+import "io"
+import "io/fs"
+import "log"
+import "net/http"
+import "net/url"
+import "os"
+import "path"
+import "path/filepath"
+import "regexp"
+import "sort"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+
+const (
+    // fetches running at once, the others wait.
+    fetchParallel = 2
+    // finished jobs are kept this long for their status.
+    fetchKeep = time.Hour
+)
+
+// -fetchallow, -fetchmaxsize and -fetchtimeout. no hosts, no fetching.
+var fetchAllowList string
+var fetchMaxSize int64 = 4 << 30
+var fetchTimeout = time.Hour
+
+var fetchHosts []string
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+
+// fetch job states.
+const (
+    fetchQueued   = "queued"
+    fetchRunning  = "running"
+    fetchDone     = "done"
+    fetchFailed   = "failed"
+    fetchCanceled = "canceled"
+)
+
+
+// fetchRequest: Path is the directory, Name defaults to the last
+// element of the url path. with SHA256 the file is only kept if it
+// matches.
+type fetchRequest struct {
+    URL       string `json:"url"`
+    Path      string `json:"path"`
+    Name      string `json:"name,omitempty"`
+    SHA256    string `json:"sha256,omitempty"`
+    Overwrite bool   `json:"overwrite"`
+}
+
+
+// fetchInfo is the status of a job. Total is -1 while the size is not
+// known, SHA256 is that of the bytes received once done.
+type fetchInfo struct {
+    ID       string     `json:"id"`
+    URL      string     `json:"url"`
+    Path     string     `json:"path"`
+    User     string     `json:"user,omitempty"`
+    Status   string     `json:"status"` // queued, running, done, failed or canceled
+    Error    string     `json:"error,omitempty"`
+    Received int64      `json:"received"`
+    Total    int64      `json:"total"`
+    SHA256   string     `json:"sha256,omitempty"`
+    Started  time.Time  `json:"started"`
+    Finished *time.Time `json:"finished,omitempty"`
+}
+
+
+type fetchList struct {
+    Jobs []fetchInfo `json:"jobs"`
+}
+
+
+type fetchJob struct {
+    id        string
+    url       *url.URL
+    path      string
+    user      string
+    ip        string
+    want      string
+    overwrite bool
+    reqID     string // of the POST, for the audit log
+    started   time.Time
+    cancel    context.CancelFunc
+    received  int64 // atomic
+    mu        sync.Mutex
+    status    string
+    err       string
+    total     int64
+    sha256    string
+    finished  time.Time
+}
+
+
+var fetches = struct {
+    sync.Mutex
+    jobs map[string]*fetchJob
+}{jobs: map[string]*fetchJob{}}
+
+var fetchSlots = make(chan struct{}, fetchParallel)
+
+
+// parse_fetch_allow reads -fetchallow, a comma list of hosts, host:port
+// or *.domain.
+func parse_fetch_allow(s string) {
+    for _, h := range strings.Split(s, ",") {
+        if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+            fetchHosts = append(fetchHosts, h)
+        }
+    }
+}
+
+
+// fetch_allowed tells if u may be fetched, redirects are checked too.
+func fetch_allowed(u *url.URL) bool {
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return false
+    }
+    host, hostport := strings.ToLower(u.Hostname()), strings.ToLower(u.Host)
+    for _, h := range fetchHosts {
+        switch {
+        case strings.HasPrefix(h, "*."):
+            if strings.HasSuffix(host, h[1:]) {
+                return true
+            }
+        case strings.Contains(h, ":"):
+            if hostport == h {
+                return true
+            }
+        case host == h:
+            return true
+        }
+    }
+    return false
+}
+
+
+var fetchClient = &http.Client{
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        if len(via) >= 10 {
+            return errors.New("too many redirects")
+        }
+        if !fetch_allowed(req.URL) {
+            return fmt.Errorf("redirect to %s, not an allowed host", req.URL.Host)
+        }
+        return nil
+    },
+}
+
+
+func (j *fetchJob) set(status, msg string) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if j.status == fetchCanceled {
+        return
+    }
+    j.status, j.err = status, msg
+}
+
+
+func (j *fetchJob) info() fetchInfo {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    fi := fetchInfo{ID: j.id, URL: j.url.String(), Path: j.path, User: j.user, Status: j.status,
+        Error: j.err, Received: atomic.LoadInt64(&j.received), Total: j.total,
+        SHA256: j.sha256, Started: j.started}
+    if !j.finished.IsZero() {
+        t := j.finished
+        fi.Finished = &t
+    }
+    return fi
+}
+
+
+// fetchReader counts and hashes the body. past -fetchmaxsize, or at
+// the end when the sha256 is not the one wanted, it fails, so that
+// save_file drops the file.
+type fetchReader struct {
+    r io.Reader
+    j *fetchJob
+    h hash.Hash
+}
+
+
+func (fr *fetchReader) Read(b []byte) (int, error) {
+    n, err := fr.r.Read(b)
+    fr.h.Write(b[:n])
+    if atomic.AddInt64(&fr.j.received, int64(n)) > fetchMaxSize {
+        return n, fmt.Errorf("larger than %d bytes", fetchMaxSize)
+    }
+    if err == io.EOF {
+        sum := hex.EncodeToString(fr.h.Sum(nil))
+        fr.j.mu.Lock()
+        fr.j.sha256 = sum
+        fr.j.mu.Unlock()
+        if fr.j.want != "" && sum != fr.j.want {
+            return n, fmt.Errorf("sha256 is %s, not %s", sum, fr.j.want)
+        }
+    }
+    return n, err
+}
+
+
+// run fetches the job's url once a slot is free.
+func (j *fetchJob) run(ctx context.Context) {
+    defer func() {
+        j.mu.Lock()
+        j.finished = time.Now()
+        j.mu.Unlock()
+        j.cancel()
+    }()
+    select {
+    case fetchSlots <- struct{}{}:
+        defer func() { <-fetchSlots }()
+    case <-ctx.Done():
+        return
+    }
+    j.set(fetchRunning, "")
+    err := j.fetch(ctx)
+    switch {
+    case ctx.Err() == context.Canceled:
+        // set by the DELETE.
+    case err != nil:
+        log.Printf("fetch %s: %v", j.url, err)
+        j.set(fetchFailed, err.Error())
+    default:
+        j.set(fetchDone, "")
+    }
+}
+
+
+func (j *fetchJob) fetch(ctx context.Context) error {
+    req, err := http.NewRequestWithContext(ctx, "GET", j.url.String(), nil)
+    if err != nil {
+        return err
+    }
+    resp, err := fetchClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 200 {
+        return fmt.Errorf("GET %s: %s", j.url, resp.Status)
+    }
+    if resp.ContentLength > fetchMaxSize {
+        return fmt.Errorf("%d bytes, larger than %d", resp.ContentLength, fetchMaxSize)
+    }
+    j.mu.Lock()
+    j.total = resp.ContentLength
+    j.mu.Unlock()
+    body := &fetchReader{r: io.LimitReader(resp.Body, fetchMaxSize+1), j: j, h: sha256.New()}
+    n, err := write_file(j.path, body, j.overwrite)
+    if err != nil {
+        return err
+    }
+    write_audit(auditEvent{Action: auditFetch, ClaimedUser: j.user, Remote: j.ip, Path: j.path,
+        Target: j.url.String(), Size: n, RequestID: j.reqID})
+    // the file dates from when it was made, not fetched.
+    if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+        os.Chtimes(filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(j.path, "/"))), time.Now(), t)
+    }
+    return nil
+}
+
+
+// prune_fetches drops jobs finished long ago, fetches must be locked.
+func prune_fetches() {
+    for id, j := range fetches.jobs {
+        j.mu.Lock()
+        old := !j.finished.IsZero() && time.Since(j.finished) > fetchKeep
+        j.mu.Unlock()
+        if old {
+            delete(fetches.jobs, id)
+        }
+    }
+}
+
+
+// fetch_api starts (POST), lists or answers (GET) and cancels (DELETE)
+// fetch jobs. like uploads, a caller sees its own jobs and admins all.
+//   curl -H 'Content-Type: application/json' -d '{"url":"http://artifacts/app-1.2.tar.gz","path":"/builds/"}' http://127.0.0.1:9898/_/api/v1/fetch
+//   curl 'http://127.0.0.1:9898/_/api/v1/fetch?id=9c2e...'
+func fetch_api(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+        start_fetch(w, r)
+        return
+    }
+    id := r.URL.Query().Get("id")
+    if id == "" && r.Method == "DELETE" {
+        serveError(w, r, 400, "need id")
+        return
+    }
+    fetches.Lock()
+    prune_fetches()
+    if id == "" {
+        all := adminAuthorized(r)
+        ip := clientIP(r)
+        list := fetchList{Jobs: []fetchInfo{}}
+        for _, j := range fetches.jobs {
+            if all || j.ip == ip {
+                list.Jobs = append(list.Jobs, j.info())
+            }
+        }
+        fetches.Unlock()
+        sort.Slice(list.Jobs, func(i, k int) bool { return list.Jobs[i].Started.Before(list.Jobs[k].Started) })
+        writeJSON(w, 200, list)
+        return
+    }
+    j := fetches.jobs[id]
+    fetches.Unlock()
+    if j == nil {
+        serveError(w, r, 404, "no such fetch job")
+        return
+    }
+    if r.Method == "DELETE" {
+        j.mu.Lock()
+        over := j.status != fetchQueued && j.status != fetchRunning
+        if !over {
+            // finished once run has stopped and cleaned up.
+            j.status = fetchCanceled
+        }
+        j.mu.Unlock()
+        if over {
+            serveError(w, r, 409, "fetch job already finished")
+            return
+        }
+        j.cancel()
+        w.WriteHeader(204)
+        return
+    }
+    writeJSON(w, 200, j.info())
+}
+
+
+// start_fetch checks a fetchRequest and queues it, 202 with the job.
+func start_fetch(w http.ResponseWriter, r *http.Request) {
+    if len(fetchHosts) == 0 {
+        serveError(w, r, 403, "fetching urls is disabled, see -fetchallow")
+        return
+    }
+    var req fetchRequest
+    if err := readJSON(r, &req); err != nil {
+        serveError(w, r, 400, "bad request: "+err.Error())
+        return
+    }
+    u, err := url.Parse(req.URL)
+    if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+        serveError(w, r, 400, "need an http or https url")
+        return
+    }
+    if !fetch_allowed(u) {
+        serveError(w, r, 403, u.Host+" is not an allowed host, see -fetchallow")
+        return
+    }
+    req.SHA256 = strings.ToLower(req.SHA256)
+    if req.SHA256 != "" && !sha256Pattern.MatchString(req.SHA256) {
+        serveError(w, r, 400, "sha256 must be 64 hex digits")
+        return
+    }
+    dir, err := apiPath(req.Path)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    name := req.Name
+    if name == "" {
+        name = path.Base(u.Path)
+    }
+    name, err = clean_upload_name(name)
+    if err != nil || strings.Contains(name, "/") {
+        serveError(w, r, 400, "bad file name, give one with name")
+        return
+    }
+    target := path.Join(dir, name)
+    if err := writeTarget(target, false); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    if _, err := lstat_in_root(strings.TrimPrefix(target, "/")); err == nil && !req.Overwrite {
+        apiFail(w, r, &fs.PathError{Op: "fetch", Path: target, Err: fs.ErrExist})
+        return
+    }
+
+    var rnd [16]byte
+    rand.Read(rnd[:])
+    ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+    j := &fetchJob{id: hex.EncodeToString(rnd[:]), url: u, path: target, user: claimedUser(r),
+        ip: clientIP(r), want: req.SHA256, overwrite: req.Overwrite, reqID: requestID(r), started: time.Now(),
+        cancel: cancel, status: fetchQueued, total: -1}
+    fetches.Lock()
+    prune_fetches()
+    fetches.jobs[j.id] = j
+    fetches.Unlock()
+    go j.run(ctx)
+    w.Header().Set("Location", apiPrefix+"/fetch?id="+j.id)
+    writeJSON(w, 202, j.info())
+}
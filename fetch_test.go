@@ -0,0 +1,209 @@
+package main
+
+// auth: github.com/liikii
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+
+// artifact_server is the host fetched from: /ok.txt, /big (no length
+// told), /redir to elsewhere and /slow, which holds until canceled.
+func artifact_server(t *testing.T, elsewhere string) *httptest.Server {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/ok.txt":
+            io.WriteString(w, "hello")
+        case "/big":
+            w.(http.Flusher).Flush()
+            for i := 0; i < 64; i++ {
+                w.Write(make([]byte, 1024))
+            }
+        case "/redir":
+            http.Redirect(w, r, elsewhere+"/ok.txt", 302)
+        case "/slow":
+            w.Header().Set("Content-Length", "1000000")
+            w.Write(make([]byte, 1000))
+            w.(http.Flusher).Flush()
+            select {
+            case <-r.Context().Done():
+            case <-time.After(10 * time.Second):
+            }
+        default:
+            http.NotFound(w, r)
+        }
+    }))
+    t.Cleanup(ts.Close)
+    return ts
+}
+
+
+// fetch_setup shares a temporary directory with an empty /in and allows
+// fetching from host.
+func fetch_setup(t *testing.T, host string) {
+    oldDst, oldRoot, oldHosts, oldMax := dst, realRoot, fetchHosts, fetchMaxSize
+    t.Cleanup(func() { dst, realRoot, fetchHosts, fetchMaxSize = oldDst, oldRoot, oldHosts, oldMax })
+    dst = t.TempDir()
+    if err := init_real_root(); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Mkdir(filepath.Join(dst, "in"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    fetchHosts = nil
+    parse_fetch_allow(host)
+}
+
+
+func fetch_call(t *testing.T, method, query, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, apiPrefix+"/fetch"+query, strings.NewReader(body))
+    if body != "" {
+        r.Header.Set("Content-Type", "application/json")
+    }
+    w := httptest.NewRecorder()
+    fetch_api(w, r)
+    return w
+}
+
+
+func start_job(t *testing.T, body string) fetchInfo {
+    w := fetch_call(t, "POST", "", body)
+    if w.Code != 202 {
+        t.Fatalf("POST %s: %d %s", body, w.Code, w.Body)
+    }
+    var fi fetchInfo
+    if err := json.Unmarshal(w.Body.Bytes(), &fi); err != nil {
+        t.Fatal(err)
+    }
+    return fi
+}
+
+
+func job_status(t *testing.T, id string) fetchInfo {
+    w := fetch_call(t, "GET", "?id="+id, "")
+    if w.Code != 200 {
+        t.Fatalf("GET job %s: %d %s", id, w.Code, w.Body)
+    }
+    var fi fetchInfo
+    if err := json.Unmarshal(w.Body.Bytes(), &fi); err != nil {
+        t.Fatal(err)
+    }
+    return fi
+}
+
+
+// wait_job polls job id until ok says so.
+func wait_job(t *testing.T, id string, ok func(fetchInfo) bool) fetchInfo {
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if fi := job_status(t, id); ok(fi) {
+            return fi
+        }
+    }
+    t.Fatalf("job %s: %+v", id, job_status(t, id))
+    return fetchInfo{}
+}
+
+
+func finished(fi fetchInfo) bool { return fi.Finished != nil }
+
+
+// no_files fails if /in holds anything, temporary files included.
+func no_files(t *testing.T) {
+    ents, err := os.ReadDir(filepath.Join(dst, "in"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, e := range ents {
+        t.Errorf("left behind: %s", e.Name())
+    }
+}
+
+
+func TestFetchDone(t *testing.T) {
+    ts := artifact_server(t, "")
+    fetch_setup(t, strings.TrimPrefix(ts.URL, "http://"))
+    sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // hello
+    fi := start_job(t, fmt.Sprintf(`{"url":%q,"path":"/in/","sha256":%q}`, ts.URL+"/ok.txt", sum))
+    fi = wait_job(t, fi.ID, finished)
+    if fi.Status != fetchDone || fi.SHA256 != sum {
+        t.Fatalf("%+v", fi)
+    }
+    if b, err := os.ReadFile(filepath.Join(dst, "in", "ok.txt")); err != nil || string(b) != "hello" {
+        t.Fatalf("%q %v", b, err)
+    }
+}
+
+
+func TestFetchHostNotAllowed(t *testing.T) {
+    ts := artifact_server(t, "")
+    fetch_setup(t, "artifacts.example")
+    w := fetch_call(t, "POST", "", fmt.Sprintf(`{"url":%q,"path":"/in/"}`, ts.URL+"/ok.txt"))
+    if w.Code != 403 {
+        t.Fatalf("%d %s", w.Code, w.Body)
+    }
+    no_files(t)
+}
+
+
+func TestFetchRedirectNotAllowed(t *testing.T) {
+    other := artifact_server(t, "")
+    ts := artifact_server(t, other.URL)
+    fetch_setup(t, strings.TrimPrefix(ts.URL, "http://"))
+    fi := start_job(t, fmt.Sprintf(`{"url":%q,"path":"/in/","name":"r.txt"}`, ts.URL+"/redir"))
+    fi = wait_job(t, fi.ID, finished)
+    if fi.Status != fetchFailed || !strings.Contains(fi.Error, "not an allowed host") {
+        t.Fatalf("%+v", fi)
+    }
+    no_files(t)
+}
+
+
+func TestFetchTooLarge(t *testing.T) {
+    ts := artifact_server(t, "")
+    fetch_setup(t, strings.TrimPrefix(ts.URL, "http://"))
+    fetchMaxSize = 10000
+    fi := start_job(t, fmt.Sprintf(`{"url":%q,"path":"/in/"}`, ts.URL+"/big"))
+    fi = wait_job(t, fi.ID, finished)
+    if fi.Status != fetchFailed || !strings.Contains(fi.Error, "larger than") {
+        t.Fatalf("%+v", fi)
+    }
+    no_files(t)
+}
+
+
+func TestFetchChecksumMismatch(t *testing.T) {
+    ts := artifact_server(t, "")
+    fetch_setup(t, strings.TrimPrefix(ts.URL, "http://"))
+    fi := start_job(t, fmt.Sprintf(`{"url":%q,"path":"/in/","sha256":%q}`, ts.URL+"/ok.txt", strings.Repeat("0", 64)))
+    fi = wait_job(t, fi.ID, finished)
+    if fi.Status != fetchFailed || !strings.Contains(fi.Error, "sha256") {
+        t.Fatalf("%+v", fi)
+    }
+    no_files(t)
+}
+
+
+func TestFetchCancel(t *testing.T) {
+    ts := artifact_server(t, "")
+    fetch_setup(t, strings.TrimPrefix(ts.URL, "http://"))
+    fi := start_job(t, fmt.Sprintf(`{"url":%q,"path":"/in/"}`, ts.URL+"/slow"))
+    wait_job(t, fi.ID, func(fi fetchInfo) bool { return fi.Status == fetchRunning && fi.Received > 0 })
+    if w := fetch_call(t, "DELETE", "?id="+fi.ID, ""); w.Code != 204 {
+        t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+    }
+    fi = wait_job(t, fi.ID, finished)
+    if fi.Status != fetchCanceled {
+        t.Fatalf("%+v", fi)
+    }
+    no_files(t)
+    if w := fetch_call(t, "DELETE", "?id="+fi.ID, ""); w.Code != 409 {
+        t.Fatalf("DELETE again: %d %s", w.Code, w.Body)
+    }
+}
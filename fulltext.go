@@ -0,0 +1,506 @@
+package main
+
+// full-text index of text files in the share: /_/search?mode=content&q=
+// auth: github.com/liikii
+
+import "bufio"
+import "encoding/gob"
+import "errors"
+import "io/fs"
+import "log"
+import "mime"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+import "unicode"
+import "unicode/utf8"
+
+
+const ftsMinToken = 2
+const ftsMaxToken = 64
+const ftsSnippetLen = 160
+
+// a file is reindexed once it was quiet this long.
+const ftsSettle = time.Second
+const ftsSaveEvery = 30 * time.Second
+
+var ftsDir string
+var ftsMaxSize int64 = 10 << 20
+
+
+// ftsDoc is one indexed file, Tokens are its distinct words.
+type ftsDoc struct {
+    Size    int64
+    ModTime time.Time
+    Tokens  []string
+}
+
+
+type ftsIndex struct {
+    mu       sync.RWMutex
+    docs     map[string]*ftsDoc          // rel path -> doc
+    postings map[string]map[string]bool  // token -> rel paths
+    dirty    bool
+
+    pmu     sync.Mutex
+    pending map[string]time.Time // rel path -> last change
+}
+
+
+var fts *ftsIndex
+
+
+var textTypes = map[string]bool{
+    "application/json":       true,
+    "application/x-ndjson":   true,
+    "application/xml":        true,
+    "application/javascript": true,
+    "application/x-sh":       true,
+}
+
+
+// textLike decides like serveContent does: extension, then sniffing.
+func textLike(p string) bool {
+    f, err := open_shared(p)
+    if err != nil {
+        return false
+    }
+    defer f.Close()
+    ctype, err := detectType(p, f)
+    if err != nil {
+        return false
+    }
+    return isTextType(ctype)
+}
+
+
+func isTextType(ctype string) bool {
+    mt, _, err := mime.ParseMediaType(ctype)
+    if err != nil {
+        return false
+    }
+    return strings.HasPrefix(mt, "text/") || textTypes[mt]
+}
+
+
+// tokenize returns the lower case words (letters and digits) of s.
+func tokenize(s string, fn func(tok string)) {
+    start := -1
+    for i, c := range s {
+        word := unicode.IsLetter(c) || unicode.IsDigit(c)
+        if word && start < 0 {
+            start = i
+        }
+        if !word && start >= 0 {
+            emitToken(s[start:i], fn)
+            start = -1
+        }
+    }
+    if start >= 0 {
+        emitToken(s[start:], fn)
+    }
+}
+
+
+func emitToken(t string, fn func(tok string)) {
+    n := utf8.RuneCountInString(t)
+    if n < ftsMinToken || n > ftsMaxToken {
+        return
+    }
+    fn(strings.ToLower(t))
+}
+
+
+func fileTokens(p string) ([]string, error) {
+    f, err := open_shared(p)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    seen := map[string]bool{}
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64<<10), 1<<20)
+    for sc.Scan() {
+        tokenize(sc.Text(), func(t string) { seen[t] = true })
+    }
+    toks := make([]string, 0, len(seen))
+    for t := range seen {
+        toks = append(toks, t)
+    }
+    sort.Strings(toks)
+    // a line too long for the scanner: keep what we read.
+    if err := sc.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+        return nil, err
+    }
+    return toks, nil
+}
+
+
+func newFtsIndex() *ftsIndex {
+    return &ftsIndex{docs: map[string]*ftsDoc{}, postings: map[string]map[string]bool{},
+        pending: map[string]time.Time{}}
+}
+
+
+// must hold mu.
+func (ix *ftsIndex) unlink(rel string) {
+    d, ok := ix.docs[rel]
+    if !ok {
+        return
+    }
+    for _, t := range d.Tokens {
+        if ps := ix.postings[t]; ps != nil {
+            delete(ps, rel)
+            if len(ps) == 0 {
+                delete(ix.postings, t)
+            }
+        }
+    }
+    delete(ix.docs, rel)
+    ix.dirty = true
+}
+
+
+// must hold mu.
+func (ix *ftsIndex) link(rel string, d *ftsDoc) {
+    ix.docs[rel] = d
+    for _, t := range d.Tokens {
+        ps := ix.postings[t]
+        if ps == nil {
+            ps = map[string]bool{}
+            ix.postings[t] = ps
+        }
+        ps[rel] = true
+    }
+    ix.dirty = true
+}
+
+
+// update reindexes rel if its size or mtime changed.
+func (ix *ftsIndex) update(rel string) {
+    p := filepath.Join(dst, filepath.FromSlash(rel))
+    fi, err := os.Stat(p)
+    if err != nil || !fi.Mode().IsRegular() || fi.Size() > ftsMaxSize || !textLike(p) {
+        ix.mu.Lock()
+        ix.unlink(rel)
+        ix.mu.Unlock()
+        return
+    }
+    ix.mu.RLock()
+    old, ok := ix.docs[rel]
+    ix.mu.RUnlock()
+    if ok && old.Size == fi.Size() && old.ModTime.Equal(fi.ModTime()) {
+        return
+    }
+    toks, err := fileTokens(p)
+    if err != nil {
+        log.Printf("fts %s: %v", rel, err)
+        return
+    }
+    ix.mu.Lock()
+    ix.unlink(rel)
+    ix.link(rel, &ftsDoc{Size: fi.Size(), ModTime: fi.ModTime(), Tokens: toks})
+    ix.mu.Unlock()
+}
+
+
+func (ix *ftsIndex) removeTree(rel string) {
+    ix.mu.Lock()
+    defer ix.mu.Unlock()
+    prefix := rel + "/"
+    for k := range ix.docs {
+        if k == rel || strings.HasPrefix(k, prefix) {
+            ix.unlink(k)
+        }
+    }
+}
+
+
+func (ix *ftsIndex) onEvent(ev fsEvent) {
+    if ev.Op == evRemove {
+        ix.removeTree(ev.Path)
+        return
+    }
+    if ev.IsDir {
+        return
+    }
+    ix.pmu.Lock()
+    ix.pending[ev.Path] = time.Now()
+    ix.pmu.Unlock()
+}
+
+
+// worker indexes files that settled, and saves the index now and then.
+func (ix *ftsIndex) worker() {
+    tick := time.NewTicker(ftsSettle / 2)
+    lastSave := time.Now()
+    for range tick.C {
+        var ready []string
+        now := time.Now()
+        ix.pmu.Lock()
+        for rel, t := range ix.pending {
+            if now.Sub(t) >= ftsSettle {
+                ready = append(ready, rel)
+                delete(ix.pending, rel)
+            }
+        }
+        ix.pmu.Unlock()
+        for _, rel := range ready {
+            ix.update(rel)
+        }
+        if now.Sub(lastSave) >= ftsSaveEvery {
+            if err := ix.save(); err != nil {
+                log.Printf("fts save: %v", err)
+            }
+            lastSave = now
+        }
+    }
+}
+
+
+func (ix *ftsIndex) file() string {
+    return filepath.Join(ftsDir, "fts.gob")
+}
+
+
+// save writes the docs, postings are rebuilt from them on load.
+func (ix *ftsIndex) save() error {
+    ix.mu.Lock()
+    if !ix.dirty {
+        ix.mu.Unlock()
+        return nil
+    }
+    docs := make(map[string]ftsDoc, len(ix.docs))
+    for k, d := range ix.docs {
+        docs[k] = *d
+    }
+    ix.dirty = false
+    ix.mu.Unlock()
+
+    tmp := ix.file() + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    if err := gob.NewEncoder(w).Encode(docs); err != nil {
+        f.Close()
+        return err
+    }
+    if err := w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp, ix.file())
+}
+
+
+func (ix *ftsIndex) load() error {
+    f, err := os.Open(ix.file())
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    var docs map[string]ftsDoc
+    if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&docs); err != nil {
+        return err
+    }
+    ix.mu.Lock()
+    defer ix.mu.Unlock()
+    for k, d := range docs {
+        d := d
+        ix.link(k, &d)
+    }
+    ix.dirty = false
+    return nil
+}
+
+
+// start loads the saved index, watches the share, then catches up
+// with what changed while the server was down.
+func start_fts() error {
+    if err := os.MkdirAll(ftsDir, 0750); err != nil {
+        return err
+    }
+    ix := newFtsIndex()
+    if err := ix.load(); err != nil {
+        log.Printf("fts: saved index unusable, rebuilding: %v", err)
+        ix = newFtsIndex()
+    }
+    tw, err := watchShare()
+    if err != nil {
+        return err
+    }
+    tw.subscribe(ix.onEvent)
+    fts = ix
+    go func() {
+        start := time.Now()
+        seen := map[string]bool{}
+        filepath.WalkDir(dst, func(p string, d fs.DirEntry, err error) error {
+            if err != nil || d.IsDir() {
+                return nil
+            }
+            rel, _ := filepath.Rel(dst, p)
+            rel = filepath.ToSlash(rel)
+            seen[rel] = true
+            ix.update(rel)
+            return nil
+        })
+        ix.mu.Lock()
+        for rel := range ix.docs {
+            if !seen[rel] {
+                ix.unlink(rel)
+            }
+        }
+        n := len(ix.docs)
+        ix.mu.Unlock()
+        if err := ix.save(); err != nil {
+            log.Printf("fts save: %v", err)
+        }
+        log.Printf("fts index: %d files in %v", n, time.Since(start))
+        go ix.worker()
+    }()
+    return nil
+}
+
+
+// query returns the rel paths holding every word of q, sorted.
+func (ix *ftsIndex) query(q string) (words []string, paths []string) {
+    seen := map[string]bool{}
+    tokenize(q, func(t string) {
+        if !seen[t] {
+            seen[t] = true
+            words = append(words, t)
+        }
+    })
+    if len(words) == 0 {
+        return nil, nil
+    }
+    ix.mu.RLock()
+    defer ix.mu.RUnlock()
+    // start from the rarest word.
+    sort.Slice(words, func(i, j int) bool { return len(ix.postings[words[i]]) < len(ix.postings[words[j]]) })
+    for rel := range ix.postings[words[0]] {
+        all := true
+        for _, t := range words[1:] {
+            if !ix.postings[t][rel] {
+                all = false
+                break
+            }
+        }
+        if all {
+            paths = append(paths, rel)
+        }
+    }
+    sort.Strings(paths)
+    return words, paths
+}
+
+
+// snippetPart is a piece of a snippet, Hit marks a matched word.
+type snippetPart struct {
+    Text string `json:"text"`
+    Hit  bool   `json:"hit,omitempty"`
+}
+
+
+// snippet finds the first line of p holding one of words.
+func snippet(p string, words []string) (line int, parts []snippetPart) {
+    f, err := open_shared(p)
+    if err != nil {
+        return 0, nil
+    }
+    defer f.Close()
+    want := map[string]bool{}
+    for _, w := range words {
+        want[w] = true
+    }
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64<<10), 1<<20)
+    for n := 1; sc.Scan(); n++ {
+        text := sc.Text()
+        first := -1
+        tokenize(text, func(t string) {
+            if first < 0 && want[t] {
+                first = strings.Index(strings.ToLower(text), t)
+            }
+        })
+        if first < 0 {
+            continue
+        }
+        return n, highlight(clip(text, first), want)
+    }
+    return 0, nil
+}
+
+
+// clip cuts a long line around byte offset at.
+func clip(text string, at int) string {
+    if len(text) <= ftsSnippetLen {
+        return text
+    }
+    start := at - ftsSnippetLen/4
+    if start < 0 {
+        start = 0
+    }
+    end := start + ftsSnippetLen
+    if end > len(text) {
+        end = len(text)
+    }
+    for start > 0 && !utf8.RuneStart(text[start]) {
+        start--
+    }
+    for end < len(text) && !utf8.RuneStart(text[end]) {
+        end++
+    }
+    s := text[start:end]
+    if start > 0 {
+        s = "…" + s
+    }
+    if end < len(text) {
+        s += "…"
+    }
+    return s
+}
+
+
+func highlight(text string, want map[string]bool) []snippetPart {
+    var parts []snippetPart
+    last := 0
+    start := -1
+    flush := func(end int) {
+        if want[strings.ToLower(text[start:end])] {
+            if start > last {
+                parts = append(parts, snippetPart{Text: text[last:start]})
+            }
+            parts = append(parts, snippetPart{Text: text[start:end], Hit: true})
+            last = end
+        }
+        start = -1
+    }
+    for i, c := range text {
+        word := unicode.IsLetter(c) || unicode.IsDigit(c)
+        if word && start < 0 {
+            start = i
+        }
+        if !word && start >= 0 {
+            flush(i)
+        }
+    }
+    if start >= 0 {
+        flush(len(text))
+    }
+    if last < len(text) {
+        parts = append(parts, snippetPart{Text: text[last:]})
+    }
+    return parts
+}
@@ -2,4 +2,12 @@ module example.com
 
 go 1.16
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/alecthomas/chroma v0.10.0
+	github.com/andybalholm/brotli v1.0.5
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.9
+	github.com/yuin/goldmark v1.4.11
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956
+)
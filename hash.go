@@ -0,0 +1,57 @@
+package main
+
+// sha256 of files for the list api, ?hash=sha256, cached by size and mtime.
+// auth: github.com/liikii
+
+import "crypto/sha256"
+import "encoding/hex"
+import "io"
+import "io/fs"
+import "sync"
+import "time"
+
+
+// entries kept before the cache starts over.
+const hashCacheMax = 100000
+
+
+type hashEntry struct {
+    size    int64
+    modTime time.Time
+    sum     string
+}
+
+
+var hashCache = struct {
+    sync.Mutex
+    files map[string]*hashEntry // slash rel path -> sum
+}{files: map[string]*hashEntry{}}
+
+
+// file_sha256 returns the hex sha256 of rel, info is its stat. a file
+// is read again only when its size or mtime changed.
+func file_sha256(rel string, info fs.FileInfo) (string, error) {
+    hashCache.Lock()
+    c := hashCache.files[rel]
+    hashCache.Unlock()
+    if c != nil && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+        return c.sum, nil
+    }
+    f, err := open_in_root(dst, rel)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    sum := hex.EncodeToString(h.Sum(nil))
+    hashCache.Lock()
+    if len(hashCache.files) >= hashCacheMax {
+        hashCache.files = map[string]*hashEntry{}
+    }
+    hashCache.files[rel] = &hashEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+    hashCache.Unlock()
+    return sum, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+// hidden files: dotfiles and per-directory .transignore (gitignore syntax).
+// auth: github.com/liikii
+
+import "bufio"
+import "os"
+import "path"
+import "path/filepath"
+import "regexp"
+import "strings"
+import "sync"
+import "time"
+
+
+var hideDotfiles = true
+var ignoreFileName = ".transignore"
+
+// -allowhidden: hidden paths matching these can still be fetched by url,
+// they stay out of listings and search.
+var allowHidden []*ignoreRule
+
+
+// ignoreRule is one line of an ignore file.
+type ignoreRule struct {
+    re      *regexp.Regexp
+    negate  bool
+    dirOnly bool
+}
+
+
+type ignoreFile struct {
+    modTime time.Time
+    size    int64
+    rules   []*ignoreRule
+}
+
+
+var ignoreCache = struct {
+    sync.Mutex
+    files map[string]*ignoreFile // local dir -> parsed ignore file
+}{files: map[string]*ignoreFile{}}
+
+
+// parse_ignore_rule turns a gitignore line into a rule, nil for blank
+// lines and comments.
+func parse_ignore_rule(line string) *ignoreRule {
+    line = strings.TrimRight(line, " \t\r")
+    if line == "" || strings.HasPrefix(line, "#") {
+        return nil
+    }
+    rule := &ignoreRule{}
+    if strings.HasPrefix(line, "!") {
+        rule.negate = true
+        line = line[1:]
+    } else if strings.HasPrefix(line, `\`) {
+        line = line[1:]
+    }
+    if strings.HasSuffix(line, "/") {
+        rule.dirOnly = true
+        line = strings.TrimRight(line, "/")
+    }
+    if line == "" {
+        return nil
+    }
+    // a slash other than at the end anchors the pattern to the
+    // directory of the ignore file, otherwise it matches at any depth.
+    anchored := strings.Contains(line, "/")
+    line = strings.TrimPrefix(line, "/")
+
+    var re strings.Builder
+    re.WriteString("^")
+    if !anchored {
+        re.WriteString("(?:.*/)?")
+    }
+    for i := 0; i < len(line); i++ {
+        c := line[i]
+        switch {
+        case strings.HasPrefix(line[i:], "**/"):
+            re.WriteString("(?:.*/)?")
+            i += 2
+        case strings.HasPrefix(line[i:], "/**") && i+3 == len(line):
+            re.WriteString("/.*")
+            i += 2
+        case strings.HasPrefix(line[i:], "**"):
+            re.WriteString(".*")
+            i++
+        case c == '*':
+            re.WriteString("[^/]*")
+        case c == '?':
+            re.WriteString("[^/]")
+        case c == '[':
+            j := strings.IndexByte(line[i+1:], ']')
+            if j < 0 {
+                re.WriteString(`\[`)
+                continue
+            }
+            class := line[i+1 : i+1+j]
+            if strings.HasPrefix(class, "!") {
+                class = "^" + class[1:]
+            }
+            re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+            i += j + 1
+        case c == '\\' && i+1 < len(line):
+            i++
+            re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+        default:
+            re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+        }
+    }
+    re.WriteString("$")
+    r, err := regexp.Compile(re.String())
+    if err != nil {
+        return nil
+    }
+    rule.re = r
+    return rule
+}
+
+
+// match reports whether rel, relative to the ignore file's directory,
+// is matched.
+func (ir *ignoreRule) match(rel string, isDir bool) bool {
+    if ir.dirOnly && !isDir {
+        return false
+    }
+    return ir.re.MatchString(rel)
+}
+
+
+// parse_allow_hidden reads -allowhidden, a comma list of patterns
+// relative to the share root.
+func parse_allow_hidden(s string) {
+    for _, p := range strings.Split(s, ",") {
+        if rule := parse_ignore_rule(strings.TrimSpace(p)); rule != nil {
+            allowHidden = append(allowHidden, rule)
+        }
+    }
+}
+
+
+// load_ignore returns the rules of dir's ignore file, re-read when it
+// changes.
+func load_ignore(dir string) []*ignoreRule {
+    p := filepath.Join(dir, ignoreFileName)
+    fi, err := os.Stat(p)
+    ignoreCache.Lock()
+    defer ignoreCache.Unlock()
+    if err != nil || !fi.Mode().IsRegular() {
+        delete(ignoreCache.files, dir)
+        return nil
+    }
+    if c := ignoreCache.files[dir]; c != nil && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+        return c.rules
+    }
+    f, err := os.Open(p)
+    if err != nil {
+        return nil
+    }
+    defer f.Close()
+    c := &ignoreFile{modTime: fi.ModTime(), size: fi.Size()}
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        if rule := parse_ignore_rule(sc.Text()); rule != nil {
+            c.rules = append(c.rules, rule)
+        }
+    }
+    ignoreCache.files[dir] = c
+    return c.rules
+}
+
+
+// hideChecker answers hidden() for paths of the share. it remembers
+// the ignore files it read, make one per request or walk.
+type hideChecker struct {
+    root  string
+    rules map[string][]*ignoreRule // slash rel dir -> rules
+}
+
+
+func newHideChecker() *hideChecker {
+    return &hideChecker{root: dst, rules: map[string][]*ignoreRule{}}
+}
+
+
+func (hc *hideChecker) dirRules(rel string) []*ignoreRule {
+    if ignoreFileName == "" {
+        return nil
+    }
+    rules, ok := hc.rules[rel]
+    if !ok {
+        rules = load_ignore(filepath.Join(hc.root, filepath.FromSlash(rel)))
+        hc.rules[rel] = rules
+    }
+    return rules
+}
+
+
+// hidden reports whether rel (slash separated, relative to the share)
+// is hidden by a dotfile rule or an ignore file of one of its
+// directories. like git, nothing below a hidden directory is shown.
+func (hc *hideChecker) hidden(rel string, isDir bool) bool {
+    rel = strings.Trim(path.Clean("/"+rel), "/")
+    if rel == "" {
+        return false
+    }
+    parts := strings.Split(rel, "/")
+    for i, name := range parts {
+        if name == ignoreFileName || strings.HasPrefix(name, tempPrefix) || (hideDotfiles && strings.HasPrefix(name, ".")) {
+            return true
+        }
+        dir := i < len(parts)-1 || isDir
+        ignored := false
+        // deeper ignore files override shallower ones, later lines
+        // override earlier ones.
+        for j := 0; j <= i; j++ {
+            base := strings.Join(parts[:j], "/")
+            sub := strings.Join(parts[j:i+1], "/")
+            for _, rule := range hc.dirRules(base) {
+                if rule.match(sub, dir) {
+                    ignored = !rule.negate
+                }
+            }
+        }
+        if ignored {
+            return true
+        }
+    }
+    return false
+}
+
+
+// fetchable: direct fetches of hidden paths 404 unless -allowhidden
+// lets them through.
+func (hc *hideChecker) fetchable(rel string, isDir bool) bool {
+    if !hc.hidden(rel, isDir) {
+        return true
+    }
+    rel = strings.Trim(path.Clean("/"+rel), "/")
+    for _, rule := range allowHidden {
+        if rule.match(rel, isDir) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,349 @@
+package main
+
+// directory listing page, rendered with html/template.
+// auth: github.com/liikii
+
+import "bytes"
+import "embed"
+import "fmt"
+import "html/template"
+import "io"
+import "io/fs"
+import "log"
+import "net/http"
+import "net/url"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+
+var version = "1.0"
+
+//go:embed templates
+var templateFS embed.FS
+
+// templates, parsed once in main by load_templates.
+var listingTmpl *template.Template
+
+// -dirindex: serve index.html in place of the listing, and/or render
+// a README below it.
+var indexHTML bool
+var indexReadme = true
+
+var readmeNames = []string{"README.md", "readme.md", "Readme.md", "README.markdown", "README"}
+
+
+// listingPage is the data model of templates/listing.html.
+// a -theme directory may replace the template, these are the fields
+// it can use:
+//
+//   .Path         url path of the directory, "/" ended.
+//   .Breadcrumbs  one crumb per path segment, root first.
+//   .Parent       url of the parent directory, "" at the root.
+//   .Entries      the directory entries, sorted by name.
+//   .Summary      file and folder counts, total size of the files.
+//   .Disk         size of the file system holding the share.
+//   .Writable     whether uploads into this directory can succeed.
+//   .Version      server version.
+//   .RequestID    id of this request, for error reports.
+//   .Readme       the rendered README of the directory, if any.
+type listingPage struct {
+    Path        string
+    Breadcrumbs []crumb
+    Parent      string
+    Entries     []listEntry
+    Summary     dirSummary
+    Disk        diskInfo
+    Writable    bool
+    Version     string
+    RequestID   string
+    Readme      template.HTML
+    // search box defaults.
+    Query       string
+    Mode        string
+}
+
+
+// crumb is a path segment, Href is the url of that directory.
+type crumb struct {
+    Name string
+    Href string
+}
+
+
+type listEntry struct {
+    Name     string      // name, "/" ended for directories
+    Href     string      // escaped relative url
+    IsDir    bool
+    IsImage  bool        // has a thumbnail: Href?thumb=<size>
+    Preview  bool        // worth a Href?view=1 link
+    Link     string      // symlink target as written, "" for other entries
+    Size     int64
+    SizeText string      // e.g. 1.50MB
+    ModTime  time.Time
+    ModText  string      // 2006-01-02 15:04:05
+    Mode     string      // e.g. -rw-r--r--
+}
+
+
+type dirSummary struct {
+    Files     int
+    Dirs      int
+    Images    int
+    TotalSize int64
+    TotalText string
+}
+
+
+type diskInfo struct {
+    Known     bool
+    Total     uint64
+    Free      uint64
+    TotalText string
+    FreeText  string
+}
+
+
+var templateFuncs = template.FuncMap{
+    "size":  formatFileSize,
+    "date":  func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+    "mod":   func(a, b int) int { return a % b },
+    "asset": assetURL,
+    "url":   urlPath,
+}
+
+
+// load_templates parses the embedded templates, then any file of the
+// same name in theme replaces its embedded default.
+func load_templates(theme string) error {
+    t, err := template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/*.html")
+    if err != nil {
+        return err
+    }
+    if theme != "" {
+        names, _ := fs.Glob(templateFS, "templates/*.html")
+        for _, name := range names {
+            name = path.Base(name)
+            b, err := os.ReadFile(filepath.Join(theme, name))
+            if os.IsNotExist(err) {
+                continue
+            }
+            if err != nil {
+                return err
+            }
+            if _, err := t.New(name).Parse(string(b)); err != nil {
+                return err
+            }
+        }
+    }
+    listingTmpl = t.Lookup("listing.html")
+    return nil
+}
+
+
+func breadcrumbs(upath string) []crumb {
+    crumbs := []crumb{{Name: "/", Href: "/"}}
+    href := "/"
+    for _, seg := range strings.Split(strings.Trim(upath, "/"), "/") {
+        if seg == "" {
+            continue
+        }
+        href += seg + "/"
+        crumbs = append(crumbs, crumb{Name: seg, Href: (&url.URL{Path: href}).String()})
+    }
+    return crumbs
+}
+
+
+func disk_info(dirPath string) diskInfo {
+    if dirPath == "" {
+        return diskInfo{}
+    }
+    total, free, ok := diskUsage(dirPath)
+    if !ok {
+        return diskInfo{}
+    }
+    return diskInfo{Known: true, Total: total, Free: free,
+        TotalText: formatFileSize(int64(total)), FreeText: formatFileSize(int64(free))}
+}
+
+
+// osPath is the local path of name in fsys, "" when it has none.
+func osPath(fsys FileSystem, name string) string {
+    var dir string
+    switch d := fsys.(type) {
+    case http.Dir:
+        dir = string(d)
+    case Dir:
+        dir = string(d)
+    default:
+        return ""
+    }
+    if dir == "" {
+        dir = "."
+    }
+    return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+
+// parse_dir_index reads -dirindex: a comma list of html and readme,
+// or "off".
+func parse_dir_index(s string) error {
+    indexHTML, indexReadme = false, false
+    for _, m := range strings.Split(s, ",") {
+        switch strings.TrimSpace(m) {
+        case "html":
+            indexHTML = true
+        case "readme":
+            indexReadme = true
+        case "", "off":
+        default:
+            return fmt.Errorf("unknown mode %q, want html, readme or off", m)
+        }
+    }
+    return nil
+}
+
+
+// dir_readme renders the first README found in dirPath, "" if none.
+func dir_readme(dirPath string) template.HTML {
+    for _, n := range readmeNames {
+        p := filepath.Join(dirPath, n)
+        fi, err := os.Stat(p)
+        if err != nil || !fi.Mode().IsRegular() || fi.Size() > previewMaxRender {
+            continue
+        }
+        f, err := open_shared(p)
+        if err != nil {
+            continue
+        }
+        src, err := io.ReadAll(f)
+        f.Close()
+        if err != nil {
+            continue
+        }
+        if !strings.Contains(n, ".") {
+            // plain text README.
+            return template.HTML("<pre>" + template.HTMLEscapeString(string(src)) + "</pre>")
+        }
+        html, err := render_markdown(src)
+        if err != nil {
+            log.Printf("readme %s: %v", p, err)
+            return ""
+        }
+        return html
+    }
+    return ""
+}
+
+
+// dirList renders the listing of f, dirPath is its local path.
+func dirList(w http.ResponseWriter, r *http.Request, f http.File, dirPath string) {
+    // Prefer to use ReadDir instead of Readdir,
+    // because the former doesn't require calling
+    // Stat on every entry of a directory on Unix.
+    var dirs anyDirs
+    var err error
+    if d, ok := f.(fs.ReadDirFile); ok {
+        var list dirEntryDirs
+        list, err = d.ReadDir(-1)
+        dirs = list
+    } else {
+        var list fileInfoDirs
+        list, err = f.Readdir(-1)
+        dirs = list
+    }
+
+    if err != nil {
+        log.Printf("http: error reading directory: %v", err)
+        serveError(w, r, 500, "Error reading directory")
+        return
+    }
+    sort.Slice(dirs, func(i, j int) bool { return dirs.name(i) < dirs.name(j) })
+    mListingEntries.Observe(float64(dirs.len()))
+
+    page := listingPage{
+        Path:        r.URL.Path,
+        Breadcrumbs: breadcrumbs(r.URL.Path),
+        Disk:        disk_info(dirPath),
+        Writable:    dirPath != "" && dirWritable(dirPath),
+        Version:     version,
+        RequestID:   requestID(r),
+        Mode:        "substr",
+    }
+    if page.Path != "/" {
+        page.Parent = "../"
+    }
+    hc := newHideChecker()
+    for i, n := 0, dirs.len(); i < n; i++ {
+        info, err := dirs.info(i)
+        if err != nil {
+            // removed since ReadDir.
+            continue
+        }
+        name := dirs.name(i)
+        rel := path.Join(r.URL.Path, name)
+        var link string
+        if info.Mode()&fs.ModeSymlink != 0 {
+            var ok bool
+            if link, info, ok = linkTarget(strings.TrimPrefix(rel, "/")); !ok {
+                continue
+            }
+        }
+        isDir := info.IsDir()
+        if hc.hidden(rel, isDir) {
+            continue
+        }
+        if isDir {
+            name += "/"
+        }
+        // name may contain '?' or '#', which must be escaped to remain
+        // part of the URL path, and not indicate the start of a query
+        // string or fragment.
+        u := url.URL{Path: name}
+        page.Entries = append(page.Entries, listEntry{
+            Name:     name,
+            Href:     u.String(),
+            IsDir:    isDir,
+            IsImage:  !isDir && isImageName(name),
+            Preview:  !isDir && previewKind(name) != "",
+            Link:     link,
+            Size:     info.Size(),
+            SizeText: formatFileSize(info.Size()),
+            ModTime:  info.ModTime(),
+            ModText:  info.ModTime().Format("2006-01-02 15:04:05"),
+            Mode:     info.Mode().String(),
+        })
+        if isDir {
+            page.Summary.Dirs++
+        } else {
+            page.Summary.Files++
+            if isImageName(name) {
+                page.Summary.Images++
+            }
+            page.Summary.TotalSize += info.Size()
+        }
+    }
+    page.Summary.TotalText = formatFileSize(page.Summary.TotalSize)
+    if indexReadme && dirPath != "" {
+        page.Readme = dir_readme(dirPath)
+    }
+
+    var buf bytes.Buffer
+    if err := listingTmpl.Execute(&buf, page); err != nil {
+        log.Printf("http: listing template: %v", err)
+        serveError(w, r, 500, "Error rendering directory")
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    // dropped again if the page gets compressed.
+    w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+    cw, done := compressDynamic(w, r)
+    defer done()
+    cw.Write(buf.Bytes())
+}
@@ -0,0 +1,289 @@
+package main
+
+// prometheus metrics, text exposition format 0.0.4.
+// auth: github.com/liikii
+
+import "crypto/subtle"
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+
+var metricsToken string
+var metricsAllow []*net.IPNet
+
+
+type metricVec struct {
+    mu     sync.Mutex
+    name   string
+    help   string
+    labels []string
+    vals   map[string]float64
+}
+
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+    return &metricVec{name: name, help: help, labels: labels, vals: map[string]float64{}}
+}
+
+
+func (m *metricVec) Add(v float64, lvs ...string) {
+    key := strings.Join(lvs, "\xff")
+    m.mu.Lock()
+    m.vals[key] += v
+    m.mu.Unlock()
+}
+
+
+func (m *metricVec) Inc(lvs ...string) { m.Add(1, lvs...) }
+
+
+func labelString(names []string, key string, extra string) string {
+    var parts []string
+    if len(names) > 0 {
+        vals := strings.Split(key, "\xff")
+        for i, n := range names {
+            parts = append(parts, n+"="+strconv.Quote(vals[i]))
+        }
+    }
+    if extra != "" {
+        parts = append(parts, extra)
+    }
+    if len(parts) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+
+func formatFloat(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+
+func (m *metricVec) write(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+    keys := make([]string, 0, len(m.vals))
+    for k := range m.vals {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, k, ""), formatFloat(m.vals[k]))
+    }
+}
+
+
+type histogramVec struct {
+    mu      sync.Mutex
+    name    string
+    help    string
+    labels  []string
+    buckets []float64
+    counts  map[string][]uint64
+    sums    map[string]float64
+}
+
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+    return &histogramVec{name: name, help: help, labels: labels, buckets: buckets,
+        counts: map[string][]uint64{}, sums: map[string]float64{}}
+}
+
+
+func (h *histogramVec) Observe(v float64, lvs ...string) {
+    key := strings.Join(lvs, "\xff")
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    c, ok := h.counts[key]
+    if !ok {
+        // last slot is +Inf
+        c = make([]uint64, len(h.buckets)+1)
+        h.counts[key] = c
+    }
+    for i, b := range h.buckets {
+        if v <= b {
+            c[i]++
+        }
+    }
+    c[len(h.buckets)]++
+    h.sums[key] += v
+}
+
+
+func (h *histogramVec) write(w io.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+    keys := make([]string, 0, len(h.counts))
+    for k := range h.counts {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        c := h.counts[k]
+        for i, b := range h.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, `le="`+formatFloat(b)+`"`), c[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, `le="+Inf"`), c[len(h.buckets)])
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, k, ""), formatFloat(h.sums[k]))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, k, ""), c[len(h.buckets)])
+    }
+}
+
+
+type gauge struct {
+    name string
+    help string
+    v    int64
+}
+
+
+func (g *gauge) Add(n int64) { atomic.AddInt64(&g.v, n) }
+
+
+func (g *gauge) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, atomic.LoadInt64(&g.v))
+}
+
+
+var (
+    mRequests = newCounterVec("trans_http_requests_total",
+        "HTTP requests by route, method and status.", "route", "method", "status")
+    mDuration = newHistogramVec("trans_http_request_duration_seconds",
+        "HTTP request latency by route.",
+        []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+        "route", "status")
+    mBytesSent = newCounterVec("trans_bytes_sent_total",
+        "Response body bytes sent by route.", "route")
+    mBytesReceived = newCounterVec("trans_bytes_received_total",
+        "Request body bytes received by route.", "route")
+    mUploadFailures = newCounterVec("trans_upload_failures_total",
+        "Failed uploads by reason.", "reason")
+    mListingEntries = newHistogramVec("trans_directory_listing_entries",
+        "Number of entries in served directory listings.",
+        []float64{0, 10, 50, 100, 500, 1000, 5000, 10000, 50000})
+    mActiveDownloads = &gauge{name: "trans_active_downloads", help: "Downloads in progress."}
+    mActiveUploads   = &gauge{name: "trans_active_uploads", help: "Uploads in progress."}
+    mEventStreams    = &gauge{name: "trans_event_streams", help: "Open live update streams."}
+)
+
+
+// routeOf is the registered mux pattern, it keeps label cardinality low.
+func routeOf(mux *http.ServeMux, r *http.Request) string {
+    _, pattern := mux.Handler(r)
+    if pattern == "" {
+        return "none"
+    }
+    return pattern
+}
+
+
+// instrument collects request metrics for every route of mux.
+func instrument(mux *http.ServeMux) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        route := routeOf(mux, r)
+        lw := &logResponseWriter{ResponseWriter: w}
+        var cr *countReader
+        if r.Body != nil {
+            cr = &countReader{ReadCloser: r.Body}
+            r.Body = cr
+        }
+        mux.ServeHTTP(lw, r)
+        status := lw.status
+        if status == 0 {
+            status = 200
+        }
+        st := strconv.Itoa(status)
+        mRequests.Inc(route, r.Method, st)
+        mDuration.Observe(time.Since(start).Seconds(), route, st)
+        mBytesSent.Add(float64(lw.bytes), route)
+        if cr != nil {
+            mBytesReceived.Add(float64(cr.n), route)
+        }
+    })
+}
+
+
+// parse_allow_list parses a comma separated list of ip or cidr.
+func parse_allow_list(s string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, p := range strings.Split(s, ",") {
+        p = strings.TrimSpace(p)
+        if p == "" {
+            continue
+        }
+        if !strings.Contains(p, "/") {
+            ip := net.ParseIP(p)
+            if ip == nil {
+                return nil, fmt.Errorf("bad address: %s", p)
+            }
+            bits := 128
+            if ip.To4() != nil {
+                ip = ip.To4()
+                bits = 32
+            }
+            nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(p)
+        if err != nil {
+            return nil, err
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+
+func ipAllowed(nets []*net.IPNet, s string) bool {
+    ip := net.ParseIP(s)
+    if ip == nil {
+        return false
+    }
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+
+// adminAuthorized guards /_/metrics and /_/admin/: a valid bearer token,
+// or a client in the allow list.
+func adminAuthorized(r *http.Request) bool {
+    got := []byte(r.Header.Get("Authorization"))
+    if metricsToken != "" && subtle.ConstantTimeCompare(got, []byte("Bearer "+metricsToken)) == 1 {
+        return true
+    }
+    return ipAllowed(metricsAllow, clientIP(r))
+}
+
+
+func metrics_handler(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(r) {
+        FastResp(w, 403)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    mRequests.write(w)
+    mDuration.write(w)
+    mBytesSent.write(w)
+    mBytesReceived.write(w)
+    mActiveDownloads.write(w)
+    mActiveUploads.write(w)
+    mEventStreams.write(w)
+    mUploadFailures.write(w)
+    mListingEntries.write(w)
+}
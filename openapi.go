@@ -0,0 +1,303 @@
+package main
+
+// /_/api/v1 routes and the OpenAPI document generated from them.
+// auth: github.com/liikii
+
+import "encoding/json"
+import "net/http"
+import "reflect"
+import "strconv"
+import "strings"
+import "time"
+
+
+// apiRoute is one operation. the same table registers the handlers and
+// writes /_/api/v1/openapi.json, so the document can't drift.
+type apiRoute struct {
+    Method  string
+    Path    string // below /_/api/v1
+    Summary string
+    Params  []apiParam
+    Body    interface{} // json body, nil if none
+    Upload  string      // other body type: multipart/form-data or application/octet-stream
+    Code    int         // success status
+    Resp    interface{} // json answer, nil for none
+    Raw     string      // non json answer type, e.g. application/octet-stream
+    Write   bool        // needs -apiwrite
+    Handler http.HandlerFunc
+}
+
+
+type apiParam struct {
+    Name     string
+    Type     string // string, integer or boolean
+    Required bool
+    Doc      string
+}
+
+
+var pathParam = apiParam{Name: "path", Type: "string", Required: true, Doc: "url path in the share, e.g. /docs/a.txt"}
+var pageParamList = []apiParam{
+    {Name: "offset", Type: "integer", Doc: "first item, default 0"},
+    {Name: "limit", Type: "integer", Doc: "items per page, default 100, at most 1000"},
+}
+
+
+var apiRoutes = []apiRoute{
+    {Method: "GET", Path: "/stat", Summary: "Describe a path", Params: []apiParam{pathParam},
+        Code: 200, Resp: statInfo{}, Handler: stat_handler},
+    {Method: "GET", Path: "/list", Summary: "List a directory, sorted by name",
+        Params: append([]apiParam{pathParam, {Name: "hash", Type: "string", Doc: "sha256: add the sha256 of each file of the page"}},
+            pageParamList...), Code: 200, Resp: listResult{}, Handler: list_api},
+    {Method: "GET", Path: "/files", Summary: "Download a file, ranges and conditional requests work",
+        Params: []apiParam{pathParam}, Code: 200, Raw: "application/octet-stream", Handler: files_api},
+    {Method: "PUT", Path: "/files", Summary: "Upload a file from the request body, resumable with offset and total",
+        Params: []apiParam{pathParam,
+            {Name: "overwrite", Type: "boolean", Doc: "replace an existing file"},
+            {Name: "mtime", Type: "string", Doc: "modification time to set, RFC 3339"},
+            {Name: "offset", Type: "integer", Doc: "resumable: where the body starts, must match GET /uploads"},
+            {Name: "total", Type: "integer", Doc: "resumable: size of the whole file, 202 until it is reached"},
+            {Name: "extract", Type: "boolean", Doc: "the body is a zip, tar or tar.gz to unpack into directory path, answers an archive result"}},
+        Upload: "application/octet-stream", Code: 201, Resp: statInfo{}, Handler: files_api},
+    {Method: "GET", Path: "/events", Summary: "Live changes of a directory or of one path, server-sent events",
+        Params: []apiParam{pathParam, {Name: "recursive", Type: "boolean", Doc: "also report changes below subdirectories"}},
+        Code: 200, Raw: "text/event-stream", Handler: events_api},
+    {Method: "GET", Path: "/progress", Summary: "Uploads in progress: the caller's, all for admins, or the one of id",
+        Params: []apiParam{{Name: "id", Type: "string", Doc: "the Upload-Id of an upload, or upload_id it was started with"}},
+        Code: 200, Resp: uploadInfoList{}, Handler: progress_api},
+    {Method: "DELETE", Path: "/progress", Summary: "Cancel an upload in progress",
+        Params: []apiParam{{Name: "id", Type: "string", Required: true, Doc: "the Upload-Id of the upload"}},
+        Code: 204, Handler: progress_api},
+    {Method: "GET", Path: "/uploads", Summary: "Bytes held of a resumable upload", Params: []apiParam{pathParam},
+        Code: 200, Resp: uploadState{}, Handler: uploads_api},
+    {Method: "DELETE", Path: "/uploads", Summary: "Drop a resumable upload", Params: []apiParam{pathParam},
+        Code: 204, Handler: uploads_api},
+    {Method: "DELETE", Path: "/files", Summary: "Delete a file or directory",
+        Params: []apiParam{pathParam, {Name: "recursive", Type: "boolean", Doc: "delete a directory that is not empty"}},
+        Code: 204, Write: true, Handler: files_api},
+    {Method: "POST", Path: "/upload", Summary: "Upload the files of a multipart form into a directory, filenames or a path field before a part may name subfolders",
+        Params: []apiParam{pathParam, {Name: "overwrite", Type: "boolean", Doc: "replace existing files"},
+            {Name: "extract", Type: "boolean", Doc: "unpack zip, tar and tar.gz parts, listed in archives"}},
+        Upload: "multipart/form-data", Code: 201, Resp: uploadResult{}, Handler: upload_api},
+    {Method: "POST", Path: "/fetch", Summary: "Download a url of an -fetchallow host into a directory, in the background",
+        Body: fetchRequest{}, Code: 202, Resp: fetchInfo{}, Handler: fetch_api},
+    {Method: "GET", Path: "/fetch", Summary: "Fetch jobs: the caller's, all for admins, or the one of id",
+        Params: []apiParam{{Name: "id", Type: "string", Doc: "the id of a job"}},
+        Code: 200, Resp: fetchList{}, Handler: fetch_api},
+    {Method: "DELETE", Path: "/fetch", Summary: "Cancel a fetch job",
+        Params: []apiParam{{Name: "id", Type: "string", Required: true, Doc: "the id of the job"}},
+        Code: 204, Handler: fetch_api},
+    {Method: "POST", Path: "/move", Summary: "Move or rename a file or directory",
+        Body: moveRequest{}, Code: 200, Resp: statInfo{}, Write: true, Handler: move_api},
+    {Method: "POST", Path: "/mkdir", Summary: "Create a directory",
+        Body: mkdirRequest{}, Code: 201, Resp: statInfo{}, Handler: mkdir_api},
+    {Method: "GET", Path: "/shares", Summary: "List share links",
+        Code: 200, Resp: shareList{}, Write: true, Handler: shares_api},
+    {Method: "POST", Path: "/shares", Summary: "Create a share link to a file, served at /_/share/<token>",
+        Body: shareRequest{}, Code: 201, Resp: shareLink{}, Write: true, Handler: shares_api},
+    {Method: "DELETE", Path: "/shares", Summary: "Revoke a share link",
+        Params: []apiParam{{Name: "token", Type: "string", Required: true}}, Code: 204, Write: true, Handler: shares_api},
+    {Method: "GET", Path: "/search", Summary: "Search file names or, with mode=content, file contents",
+        Params: append([]apiParam{
+            {Name: "q", Type: "string", Required: true, Doc: "what to look for"},
+            {Name: "mode", Type: "string", Doc: "substr (default), glob, regex or content"},
+            {Name: "path", Type: "string", Doc: "directory searched, default /"},
+            {Name: "depth", Type: "integer", Doc: "how deep to go, default unlimited"},
+        }, pageParamList...), Code: 200, Resp: searchResults{}, Handler: search_api},
+}
+
+
+// added here, openapi_handler reads apiRoutes.
+func init() {
+    apiRoutes = append(apiRoutes, apiRoute{Method: "GET", Path: "/openapi.json", Summary: "This document",
+        Code: 200, Raw: "application/json", Handler: openapi_handler})
+}
+
+
+// register_api adds the routes to mux, one handler per path that
+// dispatches on the method.
+func register_api(mux *http.ServeMux) {
+    byPath := map[string][]apiRoute{}
+    var paths []string
+    for _, rt := range apiRoutes {
+        if byPath[rt.Path] == nil {
+            paths = append(paths, rt.Path)
+        }
+        byPath[rt.Path] = append(byPath[rt.Path], rt)
+    }
+    for _, p := range paths {
+        routes := byPath[p]
+        mux.HandleFunc(apiPrefix+p, func(w http.ResponseWriter, r *http.Request) {
+            var allow []string
+            for _, rt := range routes {
+                if rt.Method == r.Method || (rt.Method == "GET" && r.Method == "HEAD") {
+                    rt.Handler(w, r)
+                    return
+                }
+                allow = append(allow, rt.Method)
+            }
+            w.Header().Set("Allow", strings.Join(allow, ", "))
+            serveError(w, r, 405, "method not allowed")
+        })
+    }
+    // everything else below /_/api/ is a json 404, not a file.
+    mux.HandleFunc(reservedPrefix+"/api/", func(w http.ResponseWriter, r *http.Request) {
+        serveError(w, r, 404, "no such api endpoint, see "+apiPrefix+"/openapi.json")
+    })
+}
+
+
+// schemaGen turns go types into json schemas, named structs go into
+// components and are referenced.
+type schemaGen struct {
+    schemas map[string]interface{}
+}
+
+
+var timeType = reflect.TypeOf(time.Time{})
+
+
+func schemaName(t reflect.Type) string {
+    n := t.Name()
+    return strings.ToUpper(n[:1]) + n[1:]
+}
+
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    switch {
+    case t == timeType:
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    case t.Kind() == reflect.Struct:
+        name := schemaName(t)
+        if _, ok := g.schemas[name]; !ok {
+            g.schemas[name] = nil // recursion guard
+            g.schemas[name] = g.object(t)
+        }
+        return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+    case t.Kind() == reflect.Slice:
+        return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+    case t.Kind() == reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+        return map[string]interface{}{"type": "integer", "format": "int64"}
+    case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    }
+    return map[string]interface{}{"type": "string"}
+}
+
+
+// object lists the json fields of t, embedded structs are inlined.
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+    props := map[string]interface{}{}
+    g.fields(t, props)
+    return map[string]interface{}{"type": "object", "properties": props}
+}
+
+
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}) {
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        if f.Anonymous && f.Type.Kind() == reflect.Struct {
+            g.fields(f.Type, props)
+            continue
+        }
+        tag := strings.Split(f.Tag.Get("json"), ",")[0]
+        if tag == "-" || f.PkgPath != "" {
+            continue
+        }
+        if tag == "" {
+            tag = f.Name
+        }
+        props[tag] = g.schema(f.Type)
+    }
+}
+
+
+// openapi_doc builds the OpenAPI 3 document of apiRoutes.
+func openapi_doc() map[string]interface{} {
+    g := &schemaGen{schemas: map[string]interface{}{}}
+    errRef := g.schema(reflect.TypeOf(errorPage{}))
+    paths := map[string]interface{}{}
+    for _, rt := range apiRoutes {
+        op := map[string]interface{}{
+            "summary":     rt.Summary,
+            "operationId": strings.ToLower(rt.Method) + strings.NewReplacer("/", "_", ".", "_").Replace(rt.Path),
+        }
+        var params []interface{}
+        for _, p := range rt.Params {
+            params = append(params, map[string]interface{}{
+                "name": p.Name, "in": "query", "required": p.Required, "description": p.Doc,
+                "schema": map[string]interface{}{"type": p.Type},
+            })
+        }
+        if params != nil {
+            op["parameters"] = params
+        }
+        switch {
+        case rt.Body != nil:
+            op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{
+                "application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(rt.Body))}}}
+        case rt.Upload == "multipart/form-data":
+            op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{
+                rt.Upload: map[string]interface{}{"schema": map[string]interface{}{
+                    "type": "object", "additionalProperties": map[string]interface{}{"type": "string", "format": "binary"}}}}}
+        case rt.Upload != "":
+            op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{
+                rt.Upload: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}}
+        }
+        ok := map[string]interface{}{"description": http.StatusText(rt.Code)}
+        switch {
+        case rt.Resp != nil:
+            ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(rt.Resp))}}
+        case rt.Raw != "":
+            ok["content"] = map[string]interface{}{rt.Raw: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}
+        }
+        op["responses"] = map[string]interface{}{
+            strconv.Itoa(rt.Code): ok,
+            "default": map[string]interface{}{"description": "error", "content": map[string]interface{}{
+                "application/json": map[string]interface{}{"schema": errRef}}},
+        }
+        if rt.Write {
+            op["description"] = "needs -apiwrite all, or admin: an address in -metricsallow or the -metricstoken bearer token."
+            op["security"] = []interface{}{map[string]interface{}{}, map[string]interface{}{"bearer": []string{}}}
+        }
+        item, _ := paths[rt.Path].(map[string]interface{})
+        if item == nil {
+            item = map[string]interface{}{}
+            paths[rt.Path] = item
+        }
+        item[strings.ToLower(rt.Method)] = op
+    }
+    return map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{
+            "title":       "trans",
+            "version":     version,
+            "description": "file sharing server api. errors are json with code, status, message and request_id.",
+        },
+        // paths are relative to the server url.
+        "servers": []interface{}{map[string]interface{}{"url": apiPrefix}},
+        "paths":   paths,
+        "components": map[string]interface{}{
+            "schemas":         g.schemas,
+            "securitySchemes": map[string]interface{}{"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"}},
+        },
+    }
+}
+
+
+func openapi_handler(w http.ResponseWriter, r *http.Request) {
+    b, err := json.MarshalIndent(openapi_doc(), "", "  ")
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Write(b)
+}
+
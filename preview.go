@@ -0,0 +1,276 @@
+package main
+
+// inline previews: /docs/readme.md?view=1
+// auth: github.com/liikii
+
+import "bytes"
+import "html/template"
+import "io"
+import "io/fs"
+import "log"
+import "mime"
+import "net/http"
+import "path"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "github.com/alecthomas/chroma"
+import chromahtml "github.com/alecthomas/chroma/formatters/html"
+import "github.com/alecthomas/chroma/lexers"
+import "github.com/alecthomas/chroma/styles"
+import "github.com/yuin/goldmark"
+import "github.com/yuin/goldmark/extension"
+
+
+const (
+    previewMarkdown = "markdown"
+    previewCode     = "code"
+    previewText     = "text"
+    previewImage    = "image"
+    previewPDF      = "pdf"
+    previewVideo    = "video"
+    previewAudio    = "audio"
+)
+
+// markdown and highlighted source bigger than this fall back to a tail.
+const previewMaxRender = 2 << 20
+const previewTailLines = 1000
+const previewMaxTailLines = 20000
+
+// goldmark drops raw html and javascript: links unless told otherwise.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+var codeFormatter = chromahtml.New(chromahtml.WithLineNumbers(true), chromahtml.TabWidth(4))
+
+
+// previewKind decides from the name only, it is used for every
+// entry of a listing.
+func previewKind(name string) string {
+    ext := strings.ToLower(path.Ext(name))
+    switch ext {
+    case ".md", ".markdown":
+        return previewMarkdown
+    case ".pdf":
+        return previewPDF
+    case ".log", ".txt", ".out", ".err":
+        return previewText
+    }
+    ctype := mime.TypeByExtension(ext)
+    switch {
+    case strings.HasPrefix(ctype, "image/"):
+        return previewImage
+    case strings.HasPrefix(ctype, "video/"):
+        return previewVideo
+    case strings.HasPrefix(ctype, "audio/"):
+        return previewAudio
+    }
+    if codeName(name) {
+        return previewCode
+    }
+    if isTextType(ctype) {
+        return previewText
+    }
+    return ""
+}
+
+
+// lexers.Match tries every lexer, listings ask once per extension.
+var codeExts sync.Map
+
+func codeName(name string) bool {
+    ext := strings.ToLower(path.Ext(name))
+    if ext == "" {
+        // Makefile, Dockerfile...
+        return lexers.Match(name) != nil
+    }
+    if v, ok := codeExts.Load(ext); ok {
+        return v.(bool)
+    }
+    ok := lexers.Match("x"+ext) != nil
+    codeExts.Store(ext, ok)
+    return ok
+}
+
+
+type previewPage struct {
+    Name        string
+    Raw         string        // url of the file itself
+    Kind        string
+    MediaType   string
+    Body        template.HTML // markdown and code
+    Lines       []numberedLine
+    FirstLine   int
+    Truncated   bool          // only the tail is shown
+    More        int           // lines= of the "show more" link
+    Size        string
+    Breadcrumbs []crumb
+    Version     string
+}
+
+
+type numberedLine struct {
+    N    int
+    Text string
+}
+
+
+// tailLines returns the last n lines of content and the number of
+// the first one. the file is read backwards until n lines are found,
+// then the part before them is scanned once to count lines.
+func tailLines(content io.ReadSeeker, size int64, n int) (lines []string, first int, err error) {
+    const chunk = 64 << 10
+    var buf []byte
+    pos := size
+    for pos > 0 && bytes.Count(buf, []byte{'\n'}) <= n {
+        step := int64(chunk)
+        if step > pos {
+            step = pos
+        }
+        pos -= step
+        b := make([]byte, step)
+        if _, err := content.Seek(pos, io.SeekStart); err != nil {
+            return nil, 0, err
+        }
+        if _, err := io.ReadFull(content, b); err != nil {
+            return nil, 0, err
+        }
+        buf = append(b, buf...)
+    }
+    text := strings.TrimSuffix(string(buf), "\n")
+    lines = strings.Split(text, "\n")
+    // when pos > 0 the first piece is a partial line, and is dropped here.
+    if len(lines) > n {
+        lines = lines[len(lines)-n:]
+    }
+    start := pos + int64(len(text)-len(strings.Join(lines, "\n")))
+    if _, err := content.Seek(0, io.SeekStart); err != nil {
+        return nil, 0, err
+    }
+    cnt, err := countLines(io.LimitReader(content, start))
+    if err != nil {
+        return nil, 0, err
+    }
+    return lines, cnt + 1, nil
+}
+
+
+func countLines(r io.Reader) (int, error) {
+    buf := make([]byte, 256<<10)
+    n := 0
+    for {
+        m, err := r.Read(buf)
+        n += bytes.Count(buf[:m], []byte{'\n'})
+        if err == io.EOF {
+            return n, nil
+        }
+        if err != nil {
+            return n, err
+        }
+    }
+}
+
+
+func render_markdown(src []byte) (template.HTML, error) {
+    var out bytes.Buffer
+    if err := markdown.Convert(src, &out); err != nil {
+        return "", err
+    }
+    return template.HTML(out.String()), nil
+}
+
+
+func render_code(name string, src []byte) (template.HTML, error) {
+    lexer := lexers.Match(name)
+    if lexer == nil {
+        lexer = lexers.Analyse(string(src))
+    }
+    if lexer == nil {
+        lexer = lexers.Fallback
+    }
+    lexer = chroma.Coalesce(lexer)
+    it, err := lexer.Tokenise(nil, string(src))
+    if err != nil {
+        return "", err
+    }
+    var out bytes.Buffer
+    if err := codeFormatter.Format(&out, styles.Get("github"), it); err != nil {
+        return "", err
+    }
+    return template.HTML(out.String()), nil
+}
+
+
+// servePreview renders the preview page of a regular file.
+func servePreview(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, d fs.FileInfo) {
+    name := d.Name()
+    page := previewPage{
+        Name:        name,
+        Raw:         urlPath(name),
+        Kind:        previewKind(name),
+        MediaType:   mime.TypeByExtension(filepath.Ext(name)),
+        Size:        formatFileSize(d.Size()),
+        Breadcrumbs: breadcrumbs(path.Dir(r.URL.Path)),
+        Version:     version,
+    }
+    if page.Kind == "" {
+        // no hint in the name, sniff like downloads do.
+        if ctype, err := detectType(name, content); err == nil && isTextType(ctype) {
+            page.Kind = previewText
+        }
+    }
+
+    small := d.Size() <= previewMaxRender
+    var err error
+    switch {
+    case page.Kind == previewMarkdown && small, page.Kind == previewCode && small:
+        var src []byte
+        src, err = io.ReadAll(content)
+        if err != nil {
+            break
+        }
+        if page.Kind == previewMarkdown {
+            page.Body, err = render_markdown(src)
+        } else {
+            page.Body, err = render_code(name, src)
+        }
+    case page.Kind == previewMarkdown, page.Kind == previewCode, page.Kind == previewText:
+        page.Kind = previewText
+        n := previewTailLines
+        if s := r.URL.Query().Get("lines"); s != "" {
+            if v, e := strconv.Atoi(s); e == nil && v > 0 {
+                n = v
+            }
+        }
+        if n > previewMaxTailLines {
+            n = previewMaxTailLines
+        }
+        var lines []string
+        lines, page.FirstLine, err = tailLines(content, d.Size(), n)
+        page.Truncated = page.FirstLine > 1
+        page.More = n * 10
+        if page.More > previewMaxTailLines {
+            page.More = previewMaxTailLines
+        }
+        for i, l := range lines {
+            page.Lines = append(page.Lines, numberedLine{N: page.FirstLine + i, Text: l})
+        }
+    }
+    if err != nil {
+        log.Printf("preview %s: %v", name, err)
+        serveError(w, r, 500, "can't preview this file")
+        return
+    }
+
+    var buf bytes.Buffer
+    if err := listingTmpl.ExecuteTemplate(&buf, "preview.html", page); err != nil {
+        log.Printf("preview template: %v", err)
+        serveError(w, r, 500, "can't preview this file")
+        return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    cw, done := compressDynamic(w, r)
+    defer done()
+    cw.Write(buf.Bytes())
+}
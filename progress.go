@@ -0,0 +1,181 @@
+package main
+
+// in-flight uploads: bytes received, rate and eta, cancellation.
+// auth: github.com/liikii
+
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "io"
+import "net/http"
+import "regexp"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+
+var errUploadCanceled = errors.New("upload canceled")
+
+// ids chosen by the client, so it can follow an upload it starts.
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+
+// trackedUpload is one upload request in progress.
+type trackedUpload struct {
+    id       string
+    path     string
+    user     string
+    ip       string
+    total    int64
+    started  time.Time
+    received int64 // atomic
+    canceled int32 // atomic
+    mu       sync.Mutex
+    file     string
+}
+
+
+// uploadInfo is the api view of a trackedUpload. Total is the size of
+// the request body, -1 when not known, and Eta is absent then.
+type uploadInfo struct {
+    ID       string    `json:"id"`
+    Path     string    `json:"path"`
+    File     string    `json:"file,omitempty"`
+    User     string    `json:"user,omitempty"`
+    Received int64     `json:"received"`
+    Total    int64     `json:"total"`
+    Rate     float64   `json:"rate"` // bytes per second since the start
+    Eta      *float64  `json:"eta,omitempty"` // seconds
+    Started  time.Time `json:"started"`
+}
+
+
+type uploadInfoList struct {
+    Uploads []uploadInfo `json:"uploads"`
+}
+
+
+var inflight = struct {
+    sync.Mutex
+    uploads map[string]*trackedUpload
+}{uploads: map[string]*trackedUpload{}}
+
+
+type trackedReader struct {
+    io.ReadCloser
+    tu *trackedUpload
+}
+
+
+func (tr *trackedReader) Read(b []byte) (int, error) {
+    if atomic.LoadInt32(&tr.tu.canceled) != 0 {
+        return 0, errUploadCanceled
+    }
+    n, err := tr.ReadCloser.Read(b)
+    atomic.AddInt64(&tr.tu.received, int64(n))
+    return n, err
+}
+
+
+// track_upload registers the upload of r into upath and counts its
+// body. the id is upload_id or the Upload-Id header when the client
+// picked one, it is sent back in Upload-Id. call done when finished.
+func track_upload(w http.ResponseWriter, r *http.Request, upath string) (tu *trackedUpload, done func()) {
+    tu = &trackedUpload{path: upath, user: claimedUser(r), ip: clientIP(r),
+        total: r.ContentLength, started: time.Now()}
+    id := r.URL.Query().Get("upload_id")
+    if id == "" {
+        id = r.Header.Get("Upload-Id")
+    }
+    inflight.Lock()
+    if !uploadIDPattern.MatchString(id) || inflight.uploads[id] != nil {
+        var rnd [16]byte
+        rand.Read(rnd[:])
+        id = hex.EncodeToString(rnd[:])
+    }
+    tu.id = id
+    inflight.uploads[id] = tu
+    inflight.Unlock()
+    w.Header().Set("Upload-Id", id)
+    if r.Body != nil {
+        r.Body = &trackedReader{ReadCloser: r.Body, tu: tu}
+    }
+    return tu, func() {
+        inflight.Lock()
+        delete(inflight.uploads, id)
+        inflight.Unlock()
+    }
+}
+
+
+// setFile names the file being written now.
+func (tu *trackedUpload) setFile(name string) {
+    tu.mu.Lock()
+    tu.file = name
+    tu.mu.Unlock()
+}
+
+
+func (tu *trackedUpload) wasCanceled() bool {
+    return atomic.LoadInt32(&tu.canceled) != 0
+}
+
+
+func (tu *trackedUpload) info() uploadInfo {
+    tu.mu.Lock()
+    file := tu.file
+    tu.mu.Unlock()
+    got := atomic.LoadInt64(&tu.received)
+    ui := uploadInfo{ID: tu.id, Path: tu.path, File: file, User: tu.user,
+        Received: got, Total: tu.total, Started: tu.started}
+    if secs := time.Since(tu.started).Seconds(); secs > 0 {
+        ui.Rate = float64(got) / secs
+    }
+    if tu.total >= 0 && ui.Rate > 0 {
+        eta := float64(tu.total-got) / ui.Rate
+        ui.Eta = &eta
+    }
+    return ui
+}
+
+
+// progress_api lists uploads in progress, the caller's own or all of
+// them for admins. with id it answers (GET) or cancels (DELETE) one,
+// knowing the id is enough for that.
+//   curl 'http://127.0.0.1:9898/_/api/v1/progress?id=4f1c...'
+func progress_api(w http.ResponseWriter, r *http.Request) {
+    id := r.URL.Query().Get("id")
+    if id == "" && r.Method == "DELETE" {
+        serveError(w, r, 400, "need id")
+        return
+    }
+    if id == "" {
+        all := adminAuthorized(r)
+        ip := clientIP(r)
+        list := uploadInfoList{Uploads: []uploadInfo{}}
+        inflight.Lock()
+        for _, tu := range inflight.uploads {
+            if all || tu.ip == ip {
+                list.Uploads = append(list.Uploads, tu.info())
+            }
+        }
+        inflight.Unlock()
+        sort.Slice(list.Uploads, func(i, j int) bool { return list.Uploads[i].Started.Before(list.Uploads[j].Started) })
+        writeJSON(w, 200, list)
+        return
+    }
+    inflight.Lock()
+    tu := inflight.uploads[id]
+    inflight.Unlock()
+    if tu == nil {
+        serveError(w, r, 404, "no such upload in progress")
+        return
+    }
+    if r.Method == "DELETE" {
+        atomic.StoreInt32(&tu.canceled, 1)
+        w.WriteHeader(204)
+        return
+    }
+    writeJSON(w, 200, tu.info())
+}
@@ -0,0 +1,203 @@
+package main
+
+// resumable uploads: PUT /_/api/v1/files?path=&offset=&total=
+// auth: github.com/liikii
+
+import "errors"
+import "io"
+import "io/fs"
+import "log"
+import "net/http"
+import "os"
+import "path"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+
+// names starting with this are the server's own temporary files, they
+// are always hidden.
+const tempPrefix = ".trans-"
+
+
+// uploadState is how much of a resumable upload the server holds, and
+// the mtime it was started with, to tell a different version of the file.
+type uploadState struct {
+    Path   string     `json:"path"`
+    Offset int64      `json:"offset"`
+    MTime  *time.Time `json:"mtime,omitempty"`
+}
+
+
+// partPath is where the bytes of a resumable upload of rel gather.
+func partPath(rel string) string {
+    return path.Join(path.Dir(rel), tempPrefix+"part."+path.Base(rel))
+}
+
+
+func partInfo(rel string) fs.FileInfo {
+    f, err := open_in_root(dst, partPath(rel))
+    if err != nil {
+        return nil
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil || !fi.Mode().IsRegular() {
+        return nil
+    }
+    return fi
+}
+
+
+func partSize(rel string) int64 {
+    if fi := partInfo(rel); fi != nil {
+        return fi.Size()
+    }
+    return 0
+}
+
+
+// set_mtime applies the mtime parameter, RFC 3339, to an upload.
+func set_mtime(r *http.Request, rel string) {
+    s := r.URL.Query().Get("mtime")
+    if s == "" {
+        return
+    }
+    t, err := time.Parse(time.RFC3339Nano, s)
+    if err != nil {
+        return
+    }
+    if err := os.Chtimes(filepath.Join(dst, filepath.FromSlash(rel)), time.Now(), t); err != nil {
+        log.Printf("mtime %s: %v", rel, err)
+    }
+}
+
+
+// put_resumable appends the body at offset to the partial upload of
+// upath. the file is moved in place once it holds total bytes, until
+// then the answer is 202 with the new offset. a wrong offset is a 409
+// with the right one in Upload-Offset.
+func put_resumable(w http.ResponseWriter, r *http.Request, upath string) {
+    q := r.URL.Query()
+    offset, err := strconv.ParseInt(q.Get("offset"), 10, 64)
+    if err != nil || offset < 0 {
+        serveError(w, r, 400, "bad offset")
+        return
+    }
+    total := int64(-1)
+    if s := q.Get("total"); s != "" {
+        if total, err = strconv.ParseInt(s, 10, 64); err != nil || total < 0 {
+            serveError(w, r, 400, "bad total")
+            return
+        }
+    }
+    overwrite := boolParam(r, "overwrite")
+    rel := strings.TrimPrefix(upath, "/")
+    if err := writeTarget(upath, false); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    exists := func() error {
+        if mode, err := lstat_in_root(rel); err == nil && (mode.IsDir() || !overwrite) {
+            return &fs.PathError{Op: "create", Path: upath, Err: fs.ErrExist}
+        }
+        return nil
+    }
+    if err := exists(); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    part := partPath(rel)
+    have := partSize(rel)
+    if offset != have {
+        w.Header().Set("Upload-Offset", strconv.FormatInt(have, 10))
+        serveError(w, r, 409, "offset mismatch, the server has "+strconv.FormatInt(have, 10)+" bytes")
+        return
+    }
+    f, err := create_in_root(part, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+    if err != nil {
+        mUploadFailures.Inc("create")
+        apiFail(w, r, err)
+        return
+    }
+    body := io.Reader(r.Body)
+    if total >= 0 {
+        // one byte more tells a body longer than announced.
+        body = io.LimitReader(r.Body, total-offset+1)
+    }
+    n, err := io.Copy(f, body)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    have = offset + n
+    set_mtime(r, part)
+    if err != nil {
+        // keep what arrived, the client resumes from there.
+        mUploadFailures.Inc("write")
+        log.Printf("api upload %s: %v at %d", upath, err, have)
+        w.Header().Set("Upload-Offset", strconv.FormatInt(have, 10))
+        if errors.Is(err, errUploadCanceled) {
+            serveError(w, r, 400, "upload canceled")
+            return
+        }
+        serveError(w, r, 500, "upload interrupted")
+        return
+    }
+    if total >= 0 && have > total {
+        remove_in_root(part, false)
+        serveError(w, r, 400, "body longer than total")
+        return
+    }
+    w.Header().Set("Upload-Offset", strconv.FormatInt(have, 10))
+    if total >= 0 && have < total {
+        writeJSON(w, 202, uploadState{Path: upath, Offset: have})
+        return
+    }
+    if err := exists(); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    if err := rename_in_root(part, rel); err != nil {
+        apiFail(w, r, err)
+        return
+    }
+    set_mtime(r, rel)
+    audit(r, auditEvent{Action: auditUpload, Path: upath, Size: have})
+    writeJSON(w, 201, stat_path(upath))
+}
+
+
+// uploads_api reports (GET) or drops (DELETE) a partial upload.
+//   curl 'http://127.0.0.1:9898/_/api/v1/uploads?path=/iso/big.iso'
+func uploads_api(w http.ResponseWriter, r *http.Request) {
+    upath, err := apiPath(r.URL.Query().Get("path"))
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    rel := strings.TrimPrefix(upath, "/")
+    if rel == "" {
+        httpError(w, r, errInvalidPath)
+        return
+    }
+    if newHideChecker().hidden(rel, false) {
+        httpError(w, r, fs.ErrNotExist)
+        return
+    }
+    switch r.Method {
+    case "GET", "HEAD":
+        st := uploadState{Path: upath}
+        if fi := partInfo(rel); fi != nil {
+            mt := fi.ModTime().UTC()
+            st.Offset, st.MTime = fi.Size(), &mt
+        }
+        writeJSON(w, 200, st)
+    case "DELETE":
+        if err := remove_in_root(partPath(rel), false); err != nil && !errors.Is(err, fs.ErrNotExist) {
+            apiFail(w, r, err)
+            return
+        }
+        w.WriteHeader(204)
+    }
+}
@@ -0,0 +1,414 @@
+package main
+
+// recursive file name search: /_/search?q=
+// auth: github.com/liikii
+
+import "context"
+import "encoding/json"
+import "errors"
+import "io/fs"
+import "log"
+import "net/http"
+import "net/url"
+import "os"
+import "path"
+import "path/filepath"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+
+const searchDefaultLimit = 200
+const searchMaxLimit = 5000
+
+var searchIndexEnabled bool
+
+var errStopWalk = errors.New("stop walk")
+
+
+// searchResult is one match, Path is the url path.
+type searchResult struct {
+    Path    string    `json:"path"`
+    Name    string    `json:"name"`
+    IsDir   bool      `json:"dir"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mtime"`
+    // content search only: first matching line.
+    Line    int           `json:"line,omitempty"`
+    Snippet []snippetPart `json:"snippet,omitempty"`
+}
+
+
+type searchQuery struct {
+    q     string
+    mode  string // substr, glob, regex or content
+    re    *regexp.Regexp
+    base  string // url path searched, "/" ended
+    depth int    // 0 is unlimited
+    limit int
+}
+
+
+func parse_search_query(r *http.Request) (*searchQuery, error) {
+    v := r.URL.Query()
+    sq := &searchQuery{q: v.Get("q"), mode: v.Get("mode"), base: v.Get("path"), limit: searchDefaultLimit}
+    if sq.q == "" {
+        return nil, errors.New("empty query")
+    }
+    if sq.base == "" {
+        sq.base = "/"
+    }
+    if containsDotDot(sq.base) {
+        return nil, errInvalidPath
+    }
+    sq.base = path.Clean("/"+sq.base)
+    if sq.base != "/" {
+        sq.base += "/"
+    }
+    switch sq.mode {
+    case "", "substr":
+        sq.mode = "substr"
+        sq.q = strings.ToLower(sq.q)
+    case "glob":
+        sq.q = strings.ToLower(sq.q)
+        if _, err := path.Match(sq.q, ""); err != nil {
+            return nil, err
+        }
+    case "regex":
+        re, err := regexp.Compile("(?i)" + sq.q)
+        if err != nil {
+            return nil, err
+        }
+        sq.re = re
+    case "content":
+    default:
+        return nil, errors.New("mode must be substr, glob, regex or content")
+    }
+    if s := v.Get("depth"); s != "" {
+        d, err := strconv.Atoi(s)
+        if err != nil || d < 0 {
+            return nil, errors.New("bad depth")
+        }
+        sq.depth = d
+    }
+    if s := v.Get("limit"); s != "" {
+        l, err := strconv.Atoi(s)
+        if err != nil || l <= 0 {
+            return nil, errors.New("bad limit")
+        }
+        sq.limit = l
+    }
+    if sq.limit > searchMaxLimit {
+        sq.limit = searchMaxLimit
+    }
+    return sq, nil
+}
+
+
+func (sq *searchQuery) match(name string) bool {
+    switch sq.mode {
+    case "glob":
+        ok, _ := path.Match(sq.q, strings.ToLower(name))
+        return ok
+    case "regex":
+        return sq.re.MatchString(name)
+    }
+    return strings.Contains(strings.ToLower(name), sq.q)
+}
+
+
+// within: rel (relative to the share) is under base and not too deep.
+func (sq *searchQuery) within(rel string) bool {
+    p := "/" + rel
+    if !strings.HasPrefix(p, sq.base) {
+        return false
+    }
+    if sq.depth > 0 && strings.Count(strings.TrimPrefix(p, sq.base), "/") >= sq.depth {
+        return false
+    }
+    return true
+}
+
+
+// searchWalk walks the share below sq.base, emit returns false to stop.
+func searchWalk(ctx context.Context, sq *searchQuery, emit func(searchResult) bool) error {
+    root := filepath.Join(dst, filepath.FromSlash(sq.base))
+    hc := newHideChecker()
+    err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+        if ctx.Err() != nil {
+            return errStopWalk
+        }
+        if err != nil {
+            // unreadable, skip it.
+            if d != nil && d.IsDir() && p != root {
+                return fs.SkipDir
+            }
+            return nil
+        }
+        if p == root {
+            return nil
+        }
+        rel, _ := filepath.Rel(dst, p)
+        rel = filepath.ToSlash(rel)
+        if !sq.within(rel) || hc.hidden(rel, d.IsDir()) {
+            if d.IsDir() {
+                return fs.SkipDir
+            }
+            return nil
+        }
+        if !sq.match(d.Name()) {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return nil
+        }
+        if !emit(newSearchResult(rel, info)) {
+            return errStopWalk
+        }
+        return nil
+    })
+    if err == errStopWalk {
+        return nil
+    }
+    return err
+}
+
+
+func newSearchResult(rel string, info fs.FileInfo) searchResult {
+    p := "/" + rel
+    if info.IsDir() {
+        p += "/"
+    }
+    return searchResult{Path: p, Name: info.Name(), IsDir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime()}
+}
+
+
+// nameIndex is the optional in-memory index of every path of the share,
+// kept fresh by the share watcher.
+type nameIndex struct {
+    mu    sync.RWMutex
+    ready bool
+    items map[string]searchResult // rel path -> entry
+}
+
+
+var searchIndex = &nameIndex{items: map[string]searchResult{}}
+
+
+func (ix *nameIndex) put(rel string) {
+    info, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(rel)))
+    if err != nil {
+        return
+    }
+    ix.mu.Lock()
+    ix.items[rel] = newSearchResult(rel, info)
+    ix.mu.Unlock()
+}
+
+
+func (ix *nameIndex) remove(rel string) {
+    ix.mu.Lock()
+    defer ix.mu.Unlock()
+    delete(ix.items, rel)
+    prefix := rel + "/"
+    for k := range ix.items {
+        if strings.HasPrefix(k, prefix) {
+            delete(ix.items, k)
+        }
+    }
+}
+
+
+func (ix *nameIndex) onEvent(ev fsEvent) {
+    switch ev.Op {
+    case evCreate, evWrite:
+        ix.put(ev.Path)
+    case evRemove:
+        ix.remove(ev.Path)
+    }
+}
+
+
+// start subscribes to the watcher first, so nothing is missed while
+// the tree is walked.
+func (ix *nameIndex) start() error {
+    tw, err := watchShare()
+    if err != nil {
+        return err
+    }
+    tw.subscribe(ix.onEvent)
+    go func() {
+        start := time.Now()
+        filepath.WalkDir(dst, func(p string, d fs.DirEntry, err error) error {
+            if err != nil || p == dst {
+                return nil
+            }
+            rel, _ := filepath.Rel(dst, p)
+            ix.put(filepath.ToSlash(rel))
+            return nil
+        })
+        ix.mu.Lock()
+        ix.ready = true
+        n := len(ix.items)
+        ix.mu.Unlock()
+        log.Printf("search index: %d entries in %v", n, time.Since(start))
+    }()
+    return nil
+}
+
+
+// search answers from the index, ok is false until it is built.
+// matches are collected under the lock and filtered and sent after
+// it, a slow client must not hold up the watcher.
+func (ix *nameIndex) search(ctx context.Context, sq *searchQuery, emit func(searchResult) bool) (ok bool) {
+    var found []searchResult
+    ix.mu.RLock()
+    if !ix.ready {
+        ix.mu.RUnlock()
+        return false
+    }
+    for rel, it := range ix.items {
+        if sq.within(rel) && sq.match(it.Name) {
+            found = append(found, it)
+        }
+    }
+    ix.mu.RUnlock()
+    sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+    // hidden paths are kept in the index, the rules may change.
+    hc := newHideChecker()
+    for _, it := range found {
+        if hc.hidden(it.Path, it.IsDir) {
+            continue
+        }
+        if ctx.Err() != nil || !emit(it) {
+            break
+        }
+    }
+    return true
+}
+
+
+type searchPage struct {
+    Query     string
+    Mode      string
+    Path      string
+    Count     int
+    Truncated bool
+    Version   string
+}
+
+
+// search_handler streams matches as they are found: html rows for
+// browsers, one json object per line (ndjson) otherwise.
+//   curl 'http://127.0.0.1:9898/_/search?q=*.log&mode=glob&path=/logs/&depth=2&limit=50'
+func search_handler(w http.ResponseWriter, r *http.Request) {
+    sq, err := parse_search_query(r)
+    if err != nil {
+        serveError(w, r, 400, "bad search: "+err.Error())
+        return
+    }
+    if sq.mode == "content" && fts == nil {
+        serveError(w, r, 400, "bad search: content search needs the server started with -ftsindex")
+        return
+    }
+    if !search_base_ok(sq.base) {
+        serveError(w, r, 404, "404 page not found")
+        return
+    }
+
+    html := wantsHTML(r) && r.URL.Query().Get("format") != "json"
+    if html {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    } else {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+    }
+    w.Header().Set("Cache-Control", "no-store")
+    cw, done := compressDynamic(w, r)
+    defer done()
+    flusher, _ := cw.(http.Flusher)
+
+    page := searchPage{Query: r.URL.Query().Get("q"), Mode: sq.mode, Path: sq.base, Version: version}
+    if html {
+        listingTmpl.ExecuteTemplate(cw, "search_head", page)
+    }
+    enc := json.NewEncoder(cw)
+    lastFlush := time.Now()
+    emit := func(res searchResult) bool {
+        if page.Count >= sq.limit {
+            page.Truncated = true
+            return false
+        }
+        page.Count++
+        if html {
+            listingTmpl.ExecuteTemplate(cw, "search_row", res)
+        } else if enc.Encode(res) != nil {
+            return false
+        }
+        if flusher != nil && time.Since(lastFlush) > 100*time.Millisecond {
+            flusher.Flush()
+            lastFlush = time.Now()
+        }
+        return true
+    }
+
+    run_search(r.Context(), sq, emit)
+    if html {
+        listingTmpl.ExecuteTemplate(cw, "search_foot", page)
+    }
+}
+
+
+// search_base_ok: the directory searched is reached like a listing
+// would be, through the symlink policy, and is not hidden.
+func search_base_ok(base string) bool {
+    rel := strings.Trim(base, "/")
+    return dir_in_root(rel) && !newHideChecker().hidden(rel, true)
+}
+
+
+// run_search picks the full-text index, the name index or a walk.
+func run_search(ctx context.Context, sq *searchQuery, emit func(searchResult) bool) {
+    if sq.mode == "content" {
+        contentSearch(ctx, sq, emit)
+    } else if !searchIndexEnabled || !searchIndex.search(ctx, sq, emit) {
+        if err := searchWalk(ctx, sq, emit); err != nil {
+            log.Printf("search: %v", err)
+        }
+    }
+}
+
+
+// contentSearch answers from the full-text index, with a snippet
+// of the first matching line of each file.
+func contentSearch(ctx context.Context, sq *searchQuery, emit func(searchResult) bool) {
+    words, paths := fts.query(sq.q)
+    hc := newHideChecker()
+    for _, rel := range paths {
+        if ctx.Err() != nil {
+            return
+        }
+        if !sq.within(rel) || hc.hidden(rel, false) {
+            continue
+        }
+        p := filepath.Join(dst, filepath.FromSlash(rel))
+        info, err := os.Stat(p)
+        if err != nil {
+            continue
+        }
+        res := newSearchResult(rel, info)
+        res.Line, res.Snippet = snippet(p, words)
+        if !emit(res) {
+            return
+        }
+    }
+}
+
+
+// urlPath escapes a path for use in a link, for templates.
+func urlPath(p string) string {
+    return (&url.URL{Path: p}).String()
+}
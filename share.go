@@ -0,0 +1,247 @@
+package main
+
+// share links: /_/share/<token> downloads one file, until it expires.
+// auth: github.com/liikii
+
+import "crypto/rand"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "io/fs"
+import "log"
+import "mime"
+import "net/http"
+import "os"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+
+const shareDefaultTTL = 7 * 24 * time.Hour
+
+const sharePrefix = reservedPrefix + "/share/"
+
+var shareFile string
+
+
+// shareLink is a public link to one file. Expires is absent for links
+// that never expire, MaxDownloads 0 is unlimited.
+type shareLink struct {
+    Token        string     `json:"token"`
+    Path         string     `json:"path"`
+    URL          string     `json:"url"`
+    User         string     `json:"user"`
+    Created      time.Time  `json:"created"`
+    Expires      *time.Time `json:"expires,omitempty"`
+    MaxDownloads int        `json:"max_downloads,omitempty"`
+    Downloads    int        `json:"downloads"`
+}
+
+
+// shareRequest: ExpiresIn in seconds, absent is 7 days, 0 never expires.
+type shareRequest struct {
+    Path         string `json:"path"`
+    ExpiresIn    *int64 `json:"expires_in,omitempty"`
+    MaxDownloads int    `json:"max_downloads,omitempty"`
+}
+
+
+type shareList struct {
+    Shares []*shareLink `json:"shares"`
+}
+
+
+var shares = struct {
+    sync.Mutex
+    links map[string]*shareLink
+}{links: map[string]*shareLink{}}
+
+
+func (s *shareLink) expired(now time.Time) bool {
+    if s.Expires != nil && now.After(*s.Expires) {
+        return true
+    }
+    return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+
+// load_shares reads -sharefile, a missing file is an empty one.
+func load_shares() error {
+    if shareFile == "" {
+        return nil
+    }
+    b, err := os.ReadFile(shareFile)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var list shareList
+    if err := json.Unmarshal(b, &list); err != nil {
+        return err
+    }
+    shares.Lock()
+    defer shares.Unlock()
+    for _, s := range list.Shares {
+        // saved before the links moved below /_/.
+        s.URL = sharePrefix + s.Token
+        shares.links[s.Token] = s
+    }
+    return nil
+}
+
+
+// save_shares writes the links, must hold shares. prune drops expired
+// ones, downloads don't prune so a used up link answers 410 for a while.
+func save_shares(prune bool) {
+    now := time.Now()
+    list := shareList{Shares: []*shareLink{}}
+    for t, s := range shares.links {
+        if prune && s.expired(now) {
+            delete(shares.links, t)
+            continue
+        }
+        list.Shares = append(list.Shares, s)
+    }
+    if shareFile == "" {
+        return
+    }
+    b, err := json.MarshalIndent(list, "", "  ")
+    if err == nil {
+        tmp := shareFile + ".tmp"
+        if err = os.WriteFile(tmp, b, 0600); err == nil {
+            err = os.Rename(tmp, shareFile)
+        }
+    }
+    if err != nil {
+        log.Printf("share links: %v", err)
+    }
+}
+
+
+//   curl -H 'Content-Type: application/json' -d '{"path":"/a.txt","expires_in":3600}' http://127.0.0.1:9898/_/api/v1/shares
+func shares_api(w http.ResponseWriter, r *http.Request) {
+    if !apiWriteAllowed(w, r) {
+        return
+    }
+    switch r.Method {
+    case "GET":
+        shares.Lock()
+        save_shares(true)
+        list := shareList{Shares: []*shareLink{}}
+        for _, s := range shares.links {
+            c := *s
+            list.Shares = append(list.Shares, &c)
+        }
+        shares.Unlock()
+        sort.Slice(list.Shares, func(i, j int) bool { return list.Shares[i].Created.Before(list.Shares[j].Created) })
+        writeJSON(w, 200, list)
+    case "POST":
+        var req shareRequest
+        if err := readJSON(r, &req); err != nil {
+            serveError(w, r, 400, "bad request: "+err.Error())
+            return
+        }
+        upath, err := apiPath(req.Path)
+        if err != nil {
+            httpError(w, r, err)
+            return
+        }
+        fi, err := lookup(upath)
+        if err != nil {
+            httpError(w, r, err)
+            return
+        }
+        if fi.IsDir() {
+            serveError(w, r, 409, "only files can be shared")
+            return
+        }
+        if req.MaxDownloads < 0 || (req.ExpiresIn != nil && *req.ExpiresIn < 0) {
+            serveError(w, r, 400, "bad request: negative expires_in or max_downloads")
+            return
+        }
+        var rnd [16]byte
+        rand.Read(rnd[:])
+        now := time.Now().UTC()
+        s := &shareLink{Token: hex.EncodeToString(rnd[:]), Path: upath, User: claimedUser(r),
+            Created: now, MaxDownloads: req.MaxDownloads}
+        s.URL = sharePrefix + s.Token
+        ttl := shareDefaultTTL
+        if req.ExpiresIn != nil {
+            ttl = time.Duration(*req.ExpiresIn) * time.Second
+        }
+        if ttl > 0 {
+            exp := now.Add(ttl)
+            s.Expires = &exp
+        }
+        shares.Lock()
+        shares.links[s.Token] = s
+        save_shares(true)
+        c := *s
+        shares.Unlock()
+        audit(r, auditEvent{Action: auditShare, Path: upath, Target: s.URL, Detail: "create"})
+        writeJSON(w, 201, &c)
+    case "DELETE":
+        token := r.URL.Query().Get("token")
+        shares.Lock()
+        s, ok := shares.links[token]
+        delete(shares.links, token)
+        save_shares(true)
+        shares.Unlock()
+        if !ok {
+            serveError(w, r, 404, "no such share link")
+            return
+        }
+        audit(r, auditEvent{Action: auditShare, Path: s.Path, Target: s.URL, Detail: "revoke"})
+        w.WriteHeader(204)
+    }
+}
+
+
+// share_handler serves GET /_/share/<token>. range requests of the same
+// link don't count as new downloads.
+func share_handler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        serveError(w, r, 405, "method not allowed")
+        return
+    }
+    token := strings.TrimPrefix(r.URL.Path, sharePrefix)
+    shares.Lock()
+    s, ok := shares.links[token]
+    if ok && s.expired(time.Now()) {
+        shares.Unlock()
+        serveError(w, r, 410, "this link has expired")
+        return
+    }
+    counted := ok && r.Method == "GET" && r.Header.Get("Range") == ""
+    if counted {
+        s.Downloads++
+        save_shares(false)
+    }
+    var upath, surl string
+    if ok {
+        upath, surl = s.Path, s.URL
+    }
+    shares.Unlock()
+    if !ok {
+        serveError(w, r, 404, "404 page not found")
+        return
+    }
+    fi, err := lookup(upath)
+    if err == nil && fi.IsDir() {
+        err = fs.ErrNotExist
+    }
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    if counted {
+        audit(r, auditEvent{Action: auditShare, Path: upath, Target: surl, Detail: "download"})
+    }
+    // the query of this url is not for serveFile.
+    r.URL.RawQuery = ""
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name()}))
+    serveFile(w, r, Dir(dst), upath, false)
+}
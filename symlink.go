@@ -0,0 +1,199 @@
+package main
+
+// symlink policy of the share: deny, root (targets inside the share) or all.
+// auth: github.com/liikii
+
+import "errors"
+import "fmt"
+import "io/fs"
+import "os"
+import "path"
+import "path/filepath"
+import "strings"
+
+
+const (
+    symlinkDeny = "deny"
+    symlinkRoot = "root"
+    symlinkAll  = "all"
+)
+
+// links followed while resolving one path, like the kernel's limit.
+const maxSymlinkHops = 40
+
+var symlinkPolicy = symlinkRoot
+
+// dst with its own symlinks resolved, absolute link targets are
+// compared against it.
+var realRoot string
+
+var errSymlink = errors.New("symlink not allowed")
+
+
+func parse_symlink_policy(s string) error {
+    switch s {
+    case symlinkDeny, symlinkRoot, symlinkAll:
+        symlinkPolicy = s
+        return nil
+    }
+    return fmt.Errorf("unknown policy %q, want deny, root or all", s)
+}
+
+
+func init_real_root() error {
+    p, err := filepath.Abs(dst)
+    if err != nil {
+        return err
+    }
+    realRoot, err = filepath.EvalSymlinks(p)
+    return err
+}
+
+
+// rootRel turns an absolute link target into a path relative to the
+// share, ok is false when it points outside.
+func rootRel(target string) (rel string, ok bool) {
+    r, err := filepath.Rel(realRoot, filepath.Clean(target))
+    if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+        return "", false
+    }
+    return filepath.ToSlash(r), true
+}
+
+
+func splitRel(rel string) []string {
+    var parts []string
+    for _, p := range strings.Split(filepath.ToSlash(rel), "/") {
+        if p != "" && p != "." {
+            parts = append(parts, p)
+        }
+    }
+    return parts
+}
+
+
+// linkError is what callers see when the policy refuses a path, it maps
+// to 403 through os.IsPermission.
+func linkError(name string) error {
+    return &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+}
+
+
+// open_shared opens the local path p, applying the policy when p is in
+// the share. readers that take paths (thumbnails, the full-text index)
+// use it in place of os.Open.
+func open_shared(p string) (*os.File, error) {
+    rel, err := filepath.Rel(dst, p)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return os.Open(p)
+    }
+    return open_in_root(dst, rel)
+}
+
+
+// create_in_root opens rel for writing, the directory is resolved under
+// the policy and the file itself is never a symlink.
+func create_in_root(rel string, flag int, perm os.FileMode) (*os.File, error) {
+    if symlinkPolicy == symlinkAll {
+        return os.OpenFile(filepath.Join(dst, filepath.FromSlash(rel)), flag, perm)
+    }
+    dir, err := open_in_root(dst, path.Dir(filepath.ToSlash(rel)))
+    if err != nil {
+        return nil, err
+    }
+    defer dir.Close()
+    return create_at(dir, path.Base(filepath.ToSlash(rel)), flag, perm)
+}
+
+
+// parent_in_root opens the directory of rel, base is the last element.
+func parent_in_root(rel string) (dir *os.File, base string, err error) {
+    rel = strings.Trim(path.Clean("/"+filepath.ToSlash(rel)), "/")
+    if rel == "" {
+        return nil, "", errInvalidPath
+    }
+    dir, err = open_in_root(dst, path.Dir(rel))
+    return dir, path.Base(rel), err
+}
+
+
+// lstat_in_root is the type of rel itself, links are not followed.
+func lstat_in_root(rel string) (fs.FileMode, error) {
+    dir, base, err := parent_in_root(rel)
+    if err != nil {
+        return 0, err
+    }
+    defer dir.Close()
+    return lstat_at(dir, base)
+}
+
+
+func mkdir_in_root(rel string, perm os.FileMode) error {
+    dir, base, err := parent_in_root(rel)
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return mkdir_at(dir, base, perm)
+}
+
+
+func remove_in_root(rel string, recursive bool) error {
+    dir, base, err := parent_in_root(rel)
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+    return remove_at(dir, base, recursive)
+}
+
+
+func rename_in_root(from, to string) error {
+    fdir, fbase, err := parent_in_root(from)
+    if err != nil {
+        return err
+    }
+    defer fdir.Close()
+    tdir, tbase, err := parent_in_root(to)
+    if err != nil {
+        return err
+    }
+    defer tdir.Close()
+    return rename_at(fdir, fbase, tdir, tbase)
+}
+
+
+// dir_in_root reports whether rel is a directory reachable under the policy.
+func dir_in_root(rel string) bool {
+    f, err := open_in_root(dst, rel)
+    if err != nil {
+        return false
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    return err == nil && fi.IsDir()
+}
+
+
+// linkTarget is what a listing shows for a symlink at rel: where it
+// points and what it points to. ok is false when the policy hides it.
+func linkTarget(rel string) (target string, info fs.FileInfo, ok bool) {
+    if symlinkPolicy == symlinkDeny {
+        return "", nil, false
+    }
+    p := filepath.Join(dst, filepath.FromSlash(rel))
+    target, err := os.Readlink(p)
+    if err != nil {
+        return "", nil, false
+    }
+    f, err := open_in_root(dst, rel)
+    if err != nil {
+        return "", nil, false
+    }
+    defer f.Close()
+    info, err = f.Stat()
+    if err != nil {
+        return "", nil, false
+    }
+    return target, info, true
+}
@@ -0,0 +1,102 @@
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// symlink policy, other systems: checked with Lstat before opening,
+// which a concurrent rename can race.
+// auth: github.com/liikii
+
+import "os"
+import "path/filepath"
+
+
+func open_in_root(root, rel string) (*os.File, error) {
+    full := filepath.Join(root, filepath.FromSlash(rel))
+    if symlinkPolicy == symlinkAll {
+        return os.Open(full)
+    }
+    cur := ""
+    todo := splitRel(rel)
+    hops := 0
+    for len(todo) > 0 {
+        name := todo[0]
+        todo = todo[1:]
+        if name == ".." {
+            if cur == "" {
+                return nil, linkError(full)
+            }
+            cur = filepath.Dir(cur)
+            if cur == "." {
+                cur = ""
+            }
+            continue
+        }
+        next := filepath.Join(cur, name)
+        fi, err := os.Lstat(filepath.Join(root, next))
+        if err != nil {
+            return nil, err
+        }
+        if fi.Mode()&os.ModeSymlink == 0 {
+            cur = next
+            continue
+        }
+        hops++
+        if symlinkPolicy == symlinkDeny || hops > maxSymlinkHops {
+            return nil, linkError(full)
+        }
+        target, err := os.Readlink(filepath.Join(root, next))
+        if err != nil {
+            return nil, err
+        }
+        if filepath.IsAbs(target) {
+            r, ok := rootRel(target)
+            if !ok {
+                return nil, linkError(full)
+            }
+            cur = ""
+            target = r
+        }
+        todo = append(splitRel(target), todo...)
+    }
+    return os.Open(filepath.Join(root, cur))
+}
+
+
+func create_at(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+    p := filepath.Join(dir.Name(), name)
+    if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+        return nil, linkError(p)
+    }
+    return os.OpenFile(p, flag, perm)
+}
+
+
+func lstat_at(dir *os.File, name string) (os.FileMode, error) {
+    fi, err := os.Lstat(filepath.Join(dir.Name(), name))
+    if err != nil {
+        return 0, err
+    }
+    return fi.Mode().Type(), nil
+}
+
+
+func mkdir_at(dir *os.File, name string, perm os.FileMode) error {
+    return os.Mkdir(filepath.Join(dir.Name(), name), perm)
+}
+
+
+func remove_at(dir *os.File, name string, recursive bool) error {
+    p := filepath.Join(dir.Name(), name)
+    if recursive {
+        if _, err := os.Lstat(p); err != nil {
+            return err
+        }
+        return os.RemoveAll(p)
+    }
+    return os.Remove(p)
+}
+
+
+func rename_at(from *os.File, fromName string, to *os.File, toName string) error {
+    return os.Rename(filepath.Join(from.Name(), fromName), filepath.Join(to.Name(), toName))
+}
@@ -0,0 +1,215 @@
+// +build linux darwin freebsd
+
+package main
+
+// path resolution one component at a time with openat, a directory
+// swapped for a symlink between check and use can't be followed.
+// auth: github.com/liikii
+
+import "errors"
+import "io/fs"
+import "os"
+import "path/filepath"
+import "golang.org/x/sys/unix"
+
+
+// open_in_root opens rel below root following symlinks as the policy
+// allows. each component is opened relative to its parent with
+// O_NOFOLLOW, links are read and resolved here, never by the kernel.
+func open_in_root(root, rel string) (*os.File, error) {
+    full := filepath.Join(root, filepath.FromSlash(rel))
+    if symlinkPolicy == symlinkAll {
+        return os.Open(full)
+    }
+    rootFd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+    if err != nil {
+        return nil, &fs.PathError{Op: "open", Path: root, Err: err}
+    }
+    // fds[i] is the directory of depth i, fds[0] the root.
+    fds := []int{rootFd}
+    closeAll := func() {
+        for _, fd := range fds {
+            unix.Close(fd)
+        }
+    }
+    todo := splitRel(rel)
+    hops := 0
+    for len(todo) > 0 {
+        name := todo[0]
+        todo = todo[1:]
+        top := fds[len(fds)-1]
+        if name == ".." {
+            if len(fds) == 1 {
+                // only a link target can climb, Dir.Open cleans the url.
+                closeAll()
+                return nil, linkError(full)
+            }
+            unix.Close(top)
+            fds = fds[:len(fds)-1]
+            continue
+        }
+        flags := unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+        if len(todo) > 0 {
+            flags |= unix.O_DIRECTORY
+        }
+        fd, err := unix.Openat(top, name, flags, 0)
+        if err == nil {
+            fds = append(fds, fd)
+            continue
+        }
+        var st unix.Stat_t
+        if unix.Fstatat(top, name, &st, unix.AT_SYMLINK_NOFOLLOW) != nil || st.Mode&unix.S_IFMT != unix.S_IFLNK {
+            closeAll()
+            return nil, &fs.PathError{Op: "open", Path: full, Err: err}
+        }
+        hops++
+        if symlinkPolicy == symlinkDeny || hops > maxSymlinkHops {
+            closeAll()
+            return nil, linkError(full)
+        }
+        target, err := readlinkat(top, name)
+        if err != nil {
+            closeAll()
+            return nil, &fs.PathError{Op: "readlink", Path: full, Err: err}
+        }
+        if filepath.IsAbs(target) {
+            r, ok := rootRel(target)
+            if !ok {
+                closeAll()
+                return nil, linkError(full)
+            }
+            for _, fd := range fds[1:] {
+                unix.Close(fd)
+            }
+            fds = fds[:1]
+            target = r
+        }
+        todo = append(splitRel(target), todo...)
+    }
+    return os.NewFile(uintptr(fds[len(fds)-1]), full), nil
+}
+
+
+func readlinkat(dirfd int, name string) (string, error) {
+    for n := 256; ; n *= 2 {
+        buf := make([]byte, n)
+        m, err := unix.Readlinkat(dirfd, name, buf)
+        if err != nil {
+            return "", err
+        }
+        if m < n {
+            return string(buf[:m]), nil
+        }
+    }
+}
+
+
+func create_at(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+    fd, err := unix.Openat(int(dir.Fd()), name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+    if err != nil {
+        if err == unix.ELOOP {
+            err = fs.ErrPermission
+        }
+        return nil, &fs.PathError{Op: "open", Path: filepath.Join(dir.Name(), name), Err: err}
+    }
+    return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+}
+
+
+// lstat_at is the type of name in dir, a symlink is not followed.
+func lstat_at(dir *os.File, name string) (fs.FileMode, error) {
+    var st unix.Stat_t
+    if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+        return 0, &fs.PathError{Op: "lstat", Path: filepath.Join(dir.Name(), name), Err: err}
+    }
+    switch st.Mode & unix.S_IFMT {
+    case unix.S_IFDIR:
+        return fs.ModeDir, nil
+    case unix.S_IFLNK:
+        return fs.ModeSymlink, nil
+    }
+    return 0, nil
+}
+
+
+func mkdir_at(dir *os.File, name string, perm os.FileMode) error {
+    if err := unix.Mkdirat(int(dir.Fd()), name, uint32(perm.Perm())); err != nil {
+        return &fs.PathError{Op: "mkdir", Path: filepath.Join(dir.Name(), name), Err: err}
+    }
+    return nil
+}
+
+
+// remove_at removes name from dir, a symlink is removed, not its target.
+func remove_at(dir *os.File, name string, recursive bool) error {
+    mode, err := lstat_at(dir, name)
+    if err != nil {
+        return err
+    }
+    if mode.IsDir() && recursive {
+        return remove_all_at(dir, name)
+    }
+    flags := 0
+    if mode.IsDir() {
+        flags = unix.AT_REMOVEDIR
+    }
+    if err := unix.Unlinkat(int(dir.Fd()), name, flags); err != nil {
+        return &fs.PathError{Op: "remove", Path: filepath.Join(dir.Name(), name), Err: err}
+    }
+    return nil
+}
+
+
+// remove_all_at removes directory name of dir and all below it, each
+// level opened from the one above. a directory swapped for a link on
+// the way is unlinked, not followed.
+func remove_all_at(dir *os.File, name string) error {
+    fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+    if err == unix.ENOTDIR || err == unix.ELOOP {
+        if err := unix.Unlinkat(int(dir.Fd()), name, 0); err != nil {
+            return &fs.PathError{Op: "remove", Path: filepath.Join(dir.Name(), name), Err: err}
+        }
+        return nil
+    }
+    if err != nil {
+        return &fs.PathError{Op: "open", Path: filepath.Join(dir.Name(), name), Err: err}
+    }
+    sub := os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name))
+    names, err := sub.Readdirnames(-1)
+    if err != nil {
+        sub.Close()
+        return err
+    }
+    for _, n := range names {
+        mode, err := lstat_at(sub, n)
+        switch {
+        case errors.Is(err, fs.ErrNotExist):
+            continue
+        case err != nil:
+        case mode.IsDir():
+            err = remove_all_at(sub, n)
+        default:
+            if uerr := unix.Unlinkat(int(sub.Fd()), n, 0); uerr != nil && uerr != unix.ENOENT {
+                err = &fs.PathError{Op: "remove", Path: filepath.Join(sub.Name(), n), Err: uerr}
+            }
+        }
+        if err != nil {
+            sub.Close()
+            return err
+        }
+    }
+    sub.Close()
+    if err := unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR); err != nil {
+        return &fs.PathError{Op: "remove", Path: filepath.Join(dir.Name(), name), Err: err}
+    }
+    return nil
+}
+
+
+func rename_at(from *os.File, fromName string, to *os.File, toName string) error {
+    if err := unix.Renameat(int(from.Fd()), fromName, int(to.Fd()), toName); err != nil {
+        return &os.LinkError{Op: "rename", Old: filepath.Join(from.Name(), fromName),
+            New: filepath.Join(to.Name(), toName), Err: err}
+    }
+    return nil
+}
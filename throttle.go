@@ -0,0 +1,358 @@
+package main
+
+// bandwidth throttling: token buckets, global, per client ip and per user.
+// auth: github.com/liikii
+
+import "context"
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+
+const throttleChunk = 32 << 10
+const bucketIdle = time.Minute
+
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+
+// reserve takes n tokens and returns how long to wait for them.
+// tokens may go negative, that debt is paid by the wait.
+func (b *tokenBucket) reserve(n int, rate int64, now time.Time) time.Duration {
+    if !b.last.IsZero() {
+        b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+    } else {
+        b.tokens = float64(rate)
+    }
+    b.last = now
+    // burst is one second of traffic.
+    if b.tokens > float64(rate) {
+        b.tokens = float64(rate)
+    }
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+
+// rateLimit is one limit (bytes per second, 0 is unlimited),
+// with a bucket per key. global limits use the key "".
+type rateLimit struct {
+    mu        sync.Mutex
+    rate      int64
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+
+func newRateLimit() *rateLimit {
+    return &rateLimit{buckets: map[string]*tokenBucket{}}
+}
+
+
+func (l *rateLimit) Rate() int64 {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.rate
+}
+
+
+func (l *rateLimit) SetRate(rate int64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.rate = rate
+    l.buckets = map[string]*tokenBucket{}
+}
+
+
+func (l *rateLimit) reserve(key string, n int, now time.Time) time.Duration {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.rate <= 0 {
+        return 0
+    }
+    if now.Sub(l.lastSweep) > bucketIdle {
+        for k, b := range l.buckets {
+            if now.Sub(b.last) > bucketIdle {
+                delete(l.buckets, k)
+            }
+        }
+        l.lastSweep = now
+    }
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{}
+        l.buckets[key] = b
+    }
+    return b.reserve(n, l.rate, now)
+}
+
+
+// rateLimits is the set of limits for one direction.
+type rateLimits struct {
+    global  *rateLimit
+    perIP   *rateLimit
+    // keyed by the claimed user name, which nothing checks: a client
+    // may send any name, so these limits are advisory.
+    perUser *rateLimit
+}
+
+
+func newRateLimits() *rateLimits {
+    return &rateLimits{global: newRateLimit(), perIP: newRateLimit(), perUser: newRateLimit()}
+}
+
+
+func (rl *rateLimits) enabled() bool {
+    return rl.global.Rate() > 0 || rl.perIP.Rate() > 0 || rl.perUser.Rate() > 0
+}
+
+
+// chunk is the largest piece that fits in the smallest burst.
+func (rl *rateLimits) chunk() int {
+    n := int64(throttleChunk)
+    for _, l := range []*rateLimit{rl.global, rl.perIP, rl.perUser} {
+        if r := l.Rate(); r > 0 && r < n {
+            n = r
+        }
+    }
+    return int(n)
+}
+
+
+func (rl *rateLimits) wait(ctx context.Context, ip, user string, n int) error {
+    now := time.Now()
+    d := rl.global.reserve("", n, now)
+    if dd := rl.perIP.reserve(ip, n, now); dd > d {
+        d = dd
+    }
+    if user != "-" {
+        if dd := rl.perUser.reserve(user, n, now); dd > d {
+            d = dd
+        }
+    }
+    if d <= 0 {
+        return nil
+    }
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-t.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+
+var downLimits = newRateLimits()
+var upLimits = newRateLimits()
+
+
+type throttledWriter struct {
+    w    io.Writer
+    ctx  context.Context
+    rl   *rateLimits
+    ip   string
+    user string
+}
+
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := tw.rl.chunk()
+        if n > len(p) {
+            n = len(p)
+        }
+        if err := tw.rl.wait(tw.ctx, tw.ip, tw.user, n); err != nil {
+            return written, err
+        }
+        m, err := tw.w.Write(p[:n])
+        written += m
+        if err != nil {
+            return written, err
+        }
+        p = p[n:]
+    }
+    return written, nil
+}
+
+
+type throttledReader struct {
+    r    io.ReadCloser
+    ctx  context.Context
+    rl   *rateLimits
+    ip   string
+    user string
+}
+
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+    if n := tr.rl.chunk(); n < len(p) {
+        p = p[:n]
+    }
+    n, err := tr.r.Read(p)
+    if n > 0 {
+        if werr := tr.rl.wait(tr.ctx, tr.ip, tr.user, n); werr != nil {
+            return n, werr
+        }
+    }
+    return n, err
+}
+
+
+func (tr *throttledReader) Close() error { return tr.r.Close() }
+
+
+// throttleDownload wraps w when a download limit is set.
+func throttleDownload(w io.Writer, r *http.Request) io.Writer {
+    if !downLimits.enabled() {
+        return w
+    }
+    return &throttledWriter{w: w, ctx: r.Context(), rl: downLimits, ip: clientIP(r), user: claimedUser(r)}
+}
+
+
+// throttleUpload wraps the request body when an upload limit is set.
+func throttleUpload(r *http.Request) {
+    if !upLimits.enabled() || r.Body == nil {
+        return
+    }
+    r.Body = &throttledReader{r: r.Body, ctx: r.Context(), rl: upLimits, ip: clientIP(r), user: claimedUser(r)}
+}
+
+
+// parse_rate parses "512K", "10M", "1G" or plain bytes per second.
+func parse_rate(s string) (int64, error) {
+    s = strings.TrimSpace(strings.ToUpper(s))
+    s = strings.TrimSuffix(s, "B")
+    mul := int64(1)
+    if s != "" {
+        switch s[len(s)-1] {
+        case 'K':
+            mul = 1 << 10
+        case 'M':
+            mul = 1 << 20
+        case 'G':
+            mul = 1 << 30
+        }
+        if mul > 1 {
+            s = s[:len(s)-1]
+        }
+    }
+    if s == "" {
+        return 0, nil
+    }
+    v, err := strconv.ParseFloat(s, 64)
+    if err != nil || v < 0 {
+        return 0, fmt.Errorf("bad rate: %q", s)
+    }
+    return int64(v * float64(mul)), nil
+}
+
+
+// rateFlag is a flag.Value setting a rateLimit.
+type rateFlag struct {
+    l *rateLimit
+}
+
+
+func (f rateFlag) String() string {
+    if f.l == nil {
+        return "0"
+    }
+    return strconv.FormatInt(f.l.Rate(), 10)
+}
+
+
+func (f rateFlag) Set(s string) error {
+    v, err := parse_rate(s)
+    if err != nil {
+        return err
+    }
+    f.l.SetRate(v)
+    return nil
+}
+
+
+type limitsDoc struct {
+    Download     *int64 `json:"download,omitempty"`
+    DownloadIP   *int64 `json:"download_per_ip,omitempty"`
+    DownloadUser *int64 `json:"download_per_user,omitempty"`
+    Upload       *int64 `json:"upload,omitempty"`
+    UploadIP     *int64 `json:"upload_per_ip,omitempty"`
+    UploadUser   *int64 `json:"upload_per_user,omitempty"`
+}
+
+
+func (d *limitsDoc) fields() []struct {
+    v **int64
+    l *rateLimit
+} {
+    return []struct {
+        v **int64
+        l *rateLimit
+    }{
+        {&d.Download, downLimits.global},
+        {&d.DownloadIP, downLimits.perIP},
+        {&d.DownloadUser, downLimits.perUser},
+        {&d.Upload, upLimits.global},
+        {&d.UploadIP, upLimits.perIP},
+        {&d.UploadUser, upLimits.perUser},
+    }
+}
+
+
+// limits_handler: GET shows the limits in bytes per second,
+// POST/PUT a json document with the fields to change (0 is unlimited).
+//   curl -X POST -d '{"download_per_ip": 1048576}' http://127.0.0.1:9898/_/admin/limits
+func limits_handler(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(r) {
+        FastResp(w, 403)
+        return
+    }
+    switch r.Method {
+    case "GET", "HEAD":
+    case "POST", "PUT":
+        var doc limitsDoc
+        if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&doc); err != nil {
+            http.Error(w, "bad limits: "+err.Error(), 400)
+            return
+        }
+        for _, f := range doc.fields() {
+            if *f.v == nil {
+                continue
+            }
+            if **f.v < 0 {
+                http.Error(w, "bad limits: negative rate", 400)
+                return
+            }
+        }
+        for _, f := range doc.fields() {
+            if *f.v != nil {
+                f.l.SetRate(**f.v)
+            }
+        }
+    default:
+        FastResp(w, 405)
+        return
+    }
+    var cur limitsDoc
+    for _, f := range cur.fields() {
+        v := f.l.Rate()
+        *f.v = &v
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(cur)
+}
@@ -0,0 +1,222 @@
+package main
+
+// image thumbnails: /photo.jpg?thumb=256
+// auth: github.com/liikii
+
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "image"
+import "image/color"
+import "image/gif"
+import "image/jpeg"
+import "image/png"
+import "io"
+import "io/fs"
+import "net/http"
+import "os"
+import "path/filepath"
+import "runtime"
+import "strconv"
+import "strings"
+import "time"
+
+
+const thumbMin = 16
+const thumbMax = 1024
+
+// larger images are not decoded, 50 megapixels is ~200MB of RGBA.
+const thumbMaxPixels = 50 << 20
+
+var thumbCacheDir string
+
+// decoding is cpu and memory heavy, one per core.
+var thumbSem = make(chan struct{}, runtime.NumCPU())
+
+
+var thumbExts = map[string]bool{
+    ".jpg":  true,
+    ".jpeg": true,
+    ".png":  true,
+    ".gif":  true,
+}
+
+
+func isImageName(name string) bool {
+    return thumbExts[strings.ToLower(filepath.Ext(name))]
+}
+
+
+// thumbKey changes whenever the file does.
+func thumbKey(p string, d fs.FileInfo, size int) string {
+    h := sha256.New()
+    fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d", p, d.ModTime().UnixNano(), d.Size(), size)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+
+// scaleDown averages the source pixels falling in each target pixel.
+func scaleDown(src image.Image, max int) image.Image {
+    b := src.Bounds()
+    sw, sh := b.Dx(), b.Dy()
+    if sw <= max && sh <= max {
+        return src
+    }
+    dw, dh := max, sh*max/sw
+    if sh > sw {
+        dw, dh = sw*max/sh, max
+    }
+    if dw < 1 {
+        dw = 1
+    }
+    if dh < 1 {
+        dh = 1
+    }
+    dstImg := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+    for y := 0; y < dh; y++ {
+        y0 := b.Min.Y + y*sh/dh
+        y1 := b.Min.Y + (y+1)*sh/dh
+        if y1 <= y0 {
+            y1 = y0 + 1
+        }
+        for x := 0; x < dw; x++ {
+            x0 := b.Min.X + x*sw/dw
+            x1 := b.Min.X + (x+1)*sw/dw
+            if x1 <= x0 {
+                x1 = x0 + 1
+            }
+            var r, g, bl, a, n uint64
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+                    r += uint64(c.R)
+                    g += uint64(c.G)
+                    bl += uint64(c.B)
+                    a += uint64(c.A)
+                    n++
+                }
+            }
+            dstImg.SetNRGBA(x, y, color.NRGBA{
+                R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8)})
+        }
+    }
+    return dstImg
+}
+
+
+// make_thumb decodes p and writes a thumbnail to out, in the type
+// thumbType gives.
+func make_thumb(p string, size int, out string) error {
+    f, err := open_shared(p)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    cfg, format, err := image.DecodeConfig(f)
+    if err != nil {
+        return err
+    }
+    if int64(cfg.Width)*int64(cfg.Height) > thumbMaxPixels {
+        return fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    var img image.Image
+    switch format {
+    case "jpeg":
+        img, err = jpeg.Decode(f)
+    case "png":
+        img, err = png.Decode(f)
+    case "gif":
+        // first frame.
+        img, err = gif.Decode(f)
+    default:
+        return fmt.Errorf("unsupported image format: %s", format)
+    }
+    if err != nil {
+        return err
+    }
+    img = scaleDown(img, size)
+
+    tmp, err := os.CreateTemp(filepath.Dir(out), ".thumb-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if thumbType(p) == "image/jpeg" {
+        err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: 80})
+    } else {
+        err = png.Encode(tmp, img)
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), out)
+}
+
+
+// jpeg stays jpeg, png and gif become png to keep transparency.
+func thumbType(p string) string {
+    if e := strings.ToLower(filepath.Ext(p)); e == ".jpg" || e == ".jpeg" {
+        return "image/jpeg"
+    }
+    return "image/png"
+}
+
+
+// serveThumb answers ?thumb=<size> for the image at local path p.
+func serveThumb(w http.ResponseWriter, r *http.Request, p string, d fs.FileInfo) {
+    size, err := strconv.Atoi(r.URL.Query().Get("thumb"))
+    if err != nil || size < thumbMin || size > thumbMax {
+        serveError(w, r, 400, fmt.Sprintf("thumb size must be %d to %d", thumbMin, thumbMax))
+        return
+    }
+    if p == "" || !isImageName(p) {
+        serveError(w, r, 400, "no thumbnail for this file")
+        return
+    }
+    if err := os.MkdirAll(thumbCacheDir, 0750); err != nil {
+        httpError(w, r, err)
+        return
+    }
+    key := thumbKey(p, d, size)
+    cached := filepath.Join(thumbCacheDir, key[:2], key)
+    if _, err := os.Stat(cached); err != nil {
+        if err := os.MkdirAll(filepath.Dir(cached), 0750); err != nil {
+            httpError(w, r, err)
+            return
+        }
+        thumbSem <- struct{}{}
+        // another request may have made it while we waited.
+        if _, err = os.Stat(cached); err != nil {
+            err = make_thumb(p, size, cached)
+        }
+        <-thumbSem
+        if err != nil {
+            serveError(w, r, 415, "can't make thumbnail: "+err.Error())
+            return
+        }
+    }
+    f, err := os.Open(cached)
+    if err != nil {
+        httpError(w, r, err)
+        return
+    }
+    defer f.Close()
+    w.Header().Set("Content-Type", thumbType(p))
+    w.Header().Set("Cache-Control", "public, max-age=86400")
+    w.Header().Set("Etag", `"`+key[:24]+`"`)
+    serveContent(w, r, filepath.Base(cached), d.ModTime().Truncate(time.Second), f)
+}
+
+
+func default_thumb_dir() string {
+    if dir, err := os.UserCacheDir(); err == nil {
+        return filepath.Join(dir, "trans", "thumbs")
+    }
+    return filepath.Join(os.TempDir(), "trans-thumbs")
+}
@@ -16,16 +16,17 @@ import "net/http"
 import "io"
 import "path/filepath"
 
-// import "context"
+import "context"
 import "errors"
 import "io/fs"
-import "net/url"
 import "path"
-import "sort"
 import "strings"
 import "time"
 import "mime"
+import "mime/multipart"
+import "net/textproto"
 import "strconv"
+import "sync"
 import "github.com/google/uuid"
 
 
@@ -80,14 +81,14 @@ func mapDirOpenError(originalErr error, name string) error {
 
 func (d Dir) Open(name string) (http.File, error) {
     if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
-        return nil, errors.New("http: invalid character in file path")
+        return nil, errInvalidPath
     }
     dir := string(d)
     if dir == "" {
         dir = "."
     }
     fullName := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
-    f, err := os.Open(fullName)
+    f, err := open_in_root(dir, path.Clean("/"+name))
     if err != nil {
         return nil, mapDirOpenError(err, fullName)
     }
@@ -121,6 +122,7 @@ type anyDirs interface {
     len() int
     name(i int) string
     isDir(i int) bool
+    info(i int) (fs.FileInfo, error)
 }
 
 type fileInfoDirs []fs.FileInfo
@@ -128,6 +130,7 @@ type fileInfoDirs []fs.FileInfo
 func (d fileInfoDirs) len() int          { return len(d) }
 func (d fileInfoDirs) isDir(i int) bool  { return d[i].IsDir() }
 func (d fileInfoDirs) name(i int) string { return d[i].Name() }
+func (d fileInfoDirs) info(i int) (fs.FileInfo, error) { return d[i], nil }
 
 type dirEntryDirs []fs.DirEntry
 
@@ -135,6 +138,7 @@ func (d dirEntryDirs) len() int          { return len(d) }
 func (d dirEntryDirs) isDir(i int) bool  { return d[i].IsDir() }
 func (d dirEntryDirs) name(i int) string { return d[i].Name() }
 func (d dirEntryDirs) get(i int) fs.DirEntry  { return d[i] }
+func (d dirEntryDirs) info(i int) (fs.FileInfo, error) { return d[i].Info() }
 
 
 var htmlReplacer = strings.NewReplacer(
@@ -152,28 +156,6 @@ func htmlEscape(s string) string {
 }
 
 
-func write_up_part(w http.ResponseWriter, src string)(int64, error){
-    sourceFileStat, err := os.Stat(src)
-    if err != nil {
-            return 0, err
-    }
-
-    if !sourceFileStat.Mode().IsRegular() {
-            return 0, fmt.Errorf("%s is not a regular file", src)
-    }
-
-    source, err := os.Open(src)
-    if err != nil {
-            return 0, err
-    }
-    defer source.Close()
-
-    nBytes, err := io.Copy(w, source)
-    return nBytes, err
-}
-
-
-
 func formatFileSize(fileSize int64) (size string) {
    if fileSize < 1024 {
       return fmt.Sprintf("%dB", fileSize)
@@ -191,77 +173,6 @@ func formatFileSize(fileSize int64) (size string) {
 }
 
 
-func dirList(w http.ResponseWriter, r *http.Request, f http.File) {
-    // Prefer to use ReadDir instead of Readdir,
-    // because the former doesn't require calling
-    // Stat on every entry of a directory on Unix.
-    var dirs anyDirs
-    var err error
-    if d, ok := f.(fs.ReadDirFile); ok {
-        var list dirEntryDirs
-        list, err = d.ReadDir(-1)
-        dirs = list
-    } else {
-        var list fileInfoDirs
-        list, err = f.Readdir(-1)
-        dirs = list
-    }
-
-    if err != nil {
-        // logf(r, "http: error reading directory: %v", err)
-        http.Error(w, "Error reading directory", 500)
-        return
-    }
-    sort.Slice(dirs, func(i, j int) bool { return dirs.name(i) < dirs.name(j) })
-
-    w.Header().Set("Content-Type", "text/html; charset=utf-8")
-
-    _, err = write_up_part(w, "static/index_part.html")
-    if err != nil {
-        // logf(r, "http: error reading directory: %v", err)
-        w.Header().Del("Content-Type")
-        http.Error(w, "Error reading directory", 500)
-        return
-    }
-
-    // fmt.Printf("dirs: %+v", dirs)
-
-    fmt.Fprintf(w, `<table><tr><th class="name_c">Name</th><th class="time_c">Last modified</th><th class="size_c">Size</th></tr>`)
-    for i, n := 0, dirs.len(); i < n; i++ {
-        // fmt.Printf("%T\n", dirs)
-        // fmt.Println(dirs.(dirEntryDirs).get(i).Info())
-
-        name := dirs.name(i)
-
-        if dirs.isDir(i) {
-            name += "/"
-        }
-
-        f_info, _ := dirs.(dirEntryDirs).get(i).Info()
-        f_size := formatFileSize(f_info.Size())
-        f_time := f_info.ModTime().Format("2006-01-02 15:04:05")
-
-
-
-        // fmt.Println(f_info, f_size, f_time)
-        // name may contain '?' or '#', which must be escaped to remain
-        // part of the URL path, and not indicate the start of a query
-        // string or fragment.
-        url := url.URL{Path: name}
-        f_name :=  fmt.Sprintf("<a class=\"filenameclass\" href=\"%s\">%s</a>\n", url.String(), htmlReplacer.Replace(name))
-
-        tr_cls := "odd"
-        if i%2 == 0 {
-            tr_cls = "even"
-        } 
-
-        // <tr><td class="name_c">%s</td><td class="time_c">%s</td><td class="size_c">%s</td></tr>
-        fmt.Fprintf(w, `<tr class="%s"><td class="name_c">%s</td><td class="time_c">%s</td><td class="size_c">%s</td></tr>`, tr_cls, f_name, f_time, f_size)
-    }
-    fmt.Fprintf(w, "</table>\n")
-}
-
-
 func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
 
 
@@ -292,18 +203,6 @@ func check_is_dir(d string) bool {
 }
 
 
-func toHTTPError(err error) (msg string, httpStatus int) {
-    // if os.IsNotExist(err) {
-    //  return "404 page not found", StatusNotFound
-    // }
-    // if os.IsPermission(err) {
-    //  return "403 Forbidden", StatusForbidden
-    // }
-    // Default:
-    // return "500 Internal Server Error", StatusInternalServerError
-    return "500 Internal Server Error", 500
-}
-
 var StatusMovedPermanently int = 301;
 var StatusNotModified int = 304;
 
@@ -394,6 +293,24 @@ func get_file_size(content io.ReadSeeker)(int64, error){
 
 
 
+// detectType uses the file's extension, or sniffs the first bytes
+// to decide between utf-8 text and binary.
+func detectType(name string, content io.ReadSeeker) (string, error) {
+    ctype := mime.TypeByExtension(filepath.Ext(name))
+    if ctype != "" {
+        return ctype, nil
+    }
+    var buf [sniffLen]byte
+    n, _ := io.ReadFull(content, buf[:])
+    ctype = http.DetectContentType(buf[:n])
+    _, err := content.Seek(0, io.SeekStart) // rewind to output whole file
+    if err != nil {
+        return "", errSeeker
+    }
+    return ctype, nil
+}
+
+
 func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReadSeeker) {
     setLastModified(w, modtime)
 
@@ -404,17 +321,11 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
     ctypes, haveType := w.Header()["Content-Type"]
     var ctype string
     if !haveType {
-        ctype = mime.TypeByExtension(filepath.Ext(name))
-        if ctype == "" {
-            // read a chunk to decide between utf-8 text and binary
-            var buf [sniffLen]byte
-            n, _ := io.ReadFull(content, buf[:])
-            ctype = http.DetectContentType(buf[:n])
-            _, err := content.Seek(0, io.SeekStart) // rewind to output whole file
-            if err != nil {
-                http.Error(w, "seeker can't seek", StatusInternalServerError)
-                return
-            }
+        var err error
+        ctype, err = detectType(name, content)
+        if err != nil {
+            serveError(w, r, StatusInternalServerError, "seeker can't seek")
+            return
         }
         w.Header().Set("Content-Type", ctype)
     } else if len(ctypes) > 0 {
@@ -423,144 +334,445 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 
     size, err := get_file_size(content)
     if err != nil {
-        http.Error(w, err.Error(), StatusInternalServerError)
+        serveError(w, r, StatusInternalServerError, err.Error())
         return
     }
 
-    fmt.Printf("file size: %d bytes\n", size)
+    // compress on the fly. the encoded length is unknown,
+    // so ranges don't apply and the etag is weak.
+    if w.Header().Get("Content-Encoding") == "" && size >= minCompressSize && compressibleType(ctype) {
+        addVary(w.Header(), "Accept-Encoding")
+        // the encoder before any header, without one the file goes as is.
+        enc := negotiateEncoding(r, encodings)
+        var ew encoder
+        if enc != "" {
+            ew = newEncoder(enc, throttleDownload(w, r))
+        }
+        if ew != nil {
+            if etag := w.Header().Get("Etag"); etag != "" {
+                w.Header().Set("Etag", "W/"+strings.TrimPrefix(encodedEtag(etag, enc), "W/"))
+            }
+            if checkIfNoneMatch(r, w.Header().Get("Etag")) == condFalse {
+                releaseEncoder(ew)
+                writeNotModified(w)
+                return
+            }
+            w.Header().Set("Content-Encoding", enc)
+            w.WriteHeader(code)
+            if r.Method == "HEAD" {
+                releaseEncoder(ew)
+                return
+            }
+            mActiveDownloads.Add(1)
+            defer mActiveDownloads.Add(-1)
+            _, err := io.Copy(ew, ctxReader{r.Context(), content})
+            ew.Close()
+            if err != nil && !errors.Is(err, context.Canceled) {
+                log.Printf("send %s: %v", name, err)
+            }
+            return
+        }
+    }
+
+    if checkIfNoneMatch(r, w.Header().Get("Etag")) == condFalse {
+        writeNotModified(w)
+        return
+    }
+
+    rangeReq := r.Header.Get("Range")
+    if checkIfRange(r, w.Header().Get("Etag"), modtime) == condFalse {
+        rangeReq = ""
+    }
 
     // handle Content-Range header.
     sendSize := size
     var sendContent io.Reader = content
-    // if size >= 0 {
-    //     ranges, err := parseRange(rangeReq, size)
-    //     if err != nil {
-    //         if err == errNoOverlap {
-    //             w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
-    //         }
-    //         Error(w, err.Error(), StatusRequestedRangeNotSatisfiable)
-    //         return
-    //     }
-    //     if sumRangesSize(ranges) > size {
-    //         // The total number of bytes in all the ranges
-    //         // is larger than the size of the file by
-    //         // itself, so this is probably an attack, or a
-    //         // dumb client. Ignore the range request.
-    //         ranges = nil
-    //     }
-    //     switch {
-    //     case len(ranges) == 1:
-    //         // RFC 7233, Section 4.1:
-    //         // "If a single part is being transferred, the server
-    //         // generating the 206 response MUST generate a
-    //         // Content-Range header field, describing what range
-    //         // of the selected representation is enclosed, and a
-    //         // payload consisting of the range.
-    //         // ...
-    //         // A server MUST NOT generate a multipart response to
-    //         // a request for a single range, since a client that
-    //         // does not request multiple parts might not support
-    //         // multipart responses."
-    //         ra := ranges[0]
-    //         if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
-    //             Error(w, err.Error(), StatusRequestedRangeNotSatisfiable)
-    //             return
-    //         }
-    //         sendSize = ra.length
-    //         code = StatusPartialContent
-    //         w.Header().Set("Content-Range", ra.contentRange(size))
-    //     case len(ranges) > 1:
-    //         sendSize = rangesMIMESize(ranges, ctype, size)
-    //         code = StatusPartialContent
-
-    //         pr, pw := io.Pipe()
-    //         mw := multipart.NewWriter(pw)
-    //         w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
-    //         sendContent = pr
-    //         defer pr.Close() // cause writing goroutine to fail and exit if CopyN doesn't finish.
-    //         go func() {
-    //             for _, ra := range ranges {
-    //                 part, err := mw.CreatePart(ra.mimeHeader(ctype, size))
-    //                 if err != nil {
-    //                     pw.CloseWithError(err)
-    //                     return
-    //                 }
-    //                 if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
-    //                     pw.CloseWithError(err)
-    //                     return
-    //                 }
-    //                 if _, err := io.CopyN(part, content, ra.length); err != nil {
-    //                     pw.CloseWithError(err)
-    //                     return
-    //                 }
-    //             }
-    //             mw.Close()
-    //             pw.Close()
-    //         }()
-    //     }
-
-    //     w.Header().Set("Accept-Ranges", "bytes")
-    //     if w.Header().Get("Content-Encoding") == "" {
-    //         w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
-    //     }
-    // }
+    ranges, err := parseRange(rangeReq, size)
+    if err != nil {
+        if err == errNoOverlap {
+            w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+        }
+        serveError(w, r, http.StatusRequestedRangeNotSatisfiable, err.Error())
+        return
+    }
+    if sumRangesSize(ranges) > size {
+        // The total number of bytes in all the ranges
+        // is larger than the size of the file by
+        // itself, so this is probably an attack, or a
+        // dumb client. Ignore the range request.
+        ranges = nil
+    }
+    switch {
+    case len(ranges) == 1:
+        // RFC 7233, Section 4.1:
+        // "If a single part is being transferred, the server
+        // generating the 206 response MUST generate a
+        // Content-Range header field, describing what range
+        // of the selected representation is enclosed, and a
+        // payload consisting of the range.
+        // ...
+        // A server MUST NOT generate a multipart response to
+        // a request for a single range, since a client that
+        // does not request multiple parts might not support
+        // multipart responses."
+        ra := ranges[0]
+        if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+            serveError(w, r, http.StatusRequestedRangeNotSatisfiable, err.Error())
+            return
+        }
+        sendSize = ra.length
+        code = http.StatusPartialContent
+        w.Header().Set("Content-Range", ra.contentRange(size))
+    case len(ranges) > 1:
+        sendSize = rangesMIMESize(ranges, ctype, size)
+        code = http.StatusPartialContent
+
+        pr, pw := io.Pipe()
+        mw := multipart.NewWriter(pw)
+        w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+        sendContent = pr
+        defer pr.Close() // cause writing goroutine to fail and exit if CopyN doesn't finish.
+        go func() {
+            for _, ra := range ranges {
+                part, err := mw.CreatePart(ra.mimeHeader(ctype, size))
+                if err != nil {
+                    pw.CloseWithError(err)
+                    return
+                }
+                if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+                    pw.CloseWithError(err)
+                    return
+                }
+                if _, err := io.CopyN(part, content, ra.length); err != nil {
+                    pw.CloseWithError(err)
+                    return
+                }
+            }
+            mw.Close()
+            pw.Close()
+        }()
+    }
 
     w.Header().Set("Accept-Ranges", "bytes")
     w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
     w.WriteHeader(code)
 
     if r.Method != "HEAD" {
-        // io.CopyN(w, sendContent, sendSize)
-        b := make([]byte, 4096)
-        for {
-            n, err := sendContent.Read(b)
-            // fmt.Printf("read file bytes: %v, err= %v \n", n, err)
-            // fmt.Printf("n = %v err = %v b = %v\n", n, err, b)
-            // fmt.Printf("b[:n] = %q\n", b[:n])
-            w.Write(b[:n])
-            w.(http.Flusher).Flush()
-            if err == io.EOF {
-                break
+        mActiveDownloads.Add(1)
+        defer mActiveDownloads.Add(-1)
+        if _, err := copyBody(w, r, sendContent, sendSize); err != nil && !errors.Is(err, context.Canceled) {
+            log.Printf("send %s: %v", name, err)
+        }
+    }
+}
+
+
+// file_etag is a strong validator made of modtime and size.
+func file_etag(d fs.FileInfo) string {
+    return fmt.Sprintf(`"%x-%x"`, d.ModTime().UnixNano(), d.Size())
+}
+
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+    s = textproto.TrimString(s)
+    start := 0
+    if strings.HasPrefix(s, "W/") {
+        start = 2
+    }
+    if len(s[start:]) < 2 || s[start] != '"' {
+        return "", ""
+    }
+    // ETag is either W/"text" or "text".
+    // See RFC 7232 2.3.
+    for i := start + 1; i < len(s); i++ {
+        c := s[i]
+        switch {
+        // Character values allowed in ETags.
+        case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+        case c == '"':
+            return s[:i+1], s[i+1:]
+        default:
+            return "", ""
+        }
+    }
+    return "", ""
+}
+
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+func etagStrongMatch(a, b string) bool {
+    return a == b && a != "" && a[0] == '"'
+}
+
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+func etagWeakMatch(a, b string) bool {
+    return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+
+func checkIfNoneMatch(r *http.Request, etag string) condResult {
+    inm := r.Header.Get("If-None-Match")
+    if inm == "" || etag == "" {
+        return condNone
+    }
+    buf := inm
+    for {
+        buf = textproto.TrimString(buf)
+        if len(buf) == 0 {
+            break
+        }
+        if buf[0] == ',' {
+            buf = buf[1:]
+            continue
+        }
+        if buf[0] == '*' {
+            return condFalse
+        }
+        e, remain := scanETag(buf)
+        if e == "" {
+            break
+        }
+        if etagWeakMatch(e, etag) {
+            return condFalse
+        }
+        buf = remain
+    }
+    return condTrue
+}
+
+
+func checkIfRange(r *http.Request, etag string, modtime time.Time) condResult {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        return condNone
+    }
+    ir := r.Header.Get("If-Range")
+    if ir == "" {
+        return condNone
+    }
+    e, _ := scanETag(ir)
+    if e != "" {
+        if etagStrongMatch(e, etag) {
+            return condTrue
+        }
+        return condFalse
+    }
+    // The If-Range value is typically the ETag value, but it may also be
+    // the modtime date. See golang.org/issue/8367.
+    if modtime.IsZero() {
+        return condFalse
+    }
+    t, err := http.ParseTime(ir)
+    if err != nil {
+        return condFalse
+    }
+    if t.Unix() == modtime.Unix() {
+        return condTrue
+    }
+    return condFalse
+}
+
+
+// errNoOverlap is returned by serveContent's parseRange if first-byte-pos of
+// all of the byte-range-spec values is greater than the content size.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+    start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+    return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+    return textproto.MIMEHeader{
+        "Content-Range": {r.contentRange(size)},
+        "Content-Type":  {contentType},
+    }
+}
+
+
+// parseRange parses a Range header string as per RFC 7233.
+// errNoOverlap is returned if none of the ranges overlap.
+func parseRange(s string, size int64) ([]httpRange, error) {
+    if s == "" {
+        return nil, nil // header not present
+    }
+    const b = "bytes="
+    if !strings.HasPrefix(s, b) {
+        return nil, errors.New("invalid range")
+    }
+    var ranges []httpRange
+    noOverlap := false
+    for _, ra := range strings.Split(s[len(b):], ",") {
+        ra = textproto.TrimString(ra)
+        if ra == "" {
+            continue
+        }
+        i := strings.Index(ra, "-")
+        if i < 0 {
+            return nil, errors.New("invalid range")
+        }
+        start, end := textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
+        var r httpRange
+        if start == "" {
+            // If no start is specified, end specifies the
+            // range start relative to the end of the file,
+            // and we are dealing with <suffix-length>
+            // which has to be a non-negative integer as per
+            // RFC 7233 Section 2.1 "Byte-Ranges".
+            if end == "" || end[0] == '-' {
+                return nil, errors.New("invalid range")
+            }
+            i, err := strconv.ParseInt(end, 10, 64)
+            if i < 0 || err != nil {
+                return nil, errors.New("invalid range")
+            }
+            if i > size {
+                i = size
+            }
+            r.start = size - i
+            r.length = size - r.start
+        } else {
+            i, err := strconv.ParseInt(start, 10, 64)
+            if err != nil || i < 0 {
+                return nil, errors.New("invalid range")
+            }
+            if i >= size {
+                // If the range begins after the size of the content,
+                // then it does not overlap.
+                noOverlap = true
+                continue
+            }
+            r.start = i
+            if end == "" {
+                // If no end is specified, range extends to end of the file.
+                r.length = size - r.start
+            } else {
+                i, err := strconv.ParseInt(end, 10, 64)
+                if err != nil || r.start > i {
+                    return nil, errors.New("invalid range")
+                }
+                if i >= size {
+                    i = size - 1
+                }
+                r.length = i - r.start + 1
             }
         }
+        ranges = append(ranges, r)
+    }
+    if noOverlap && len(ranges) == 0 {
+        // The specified ranges did not overlap with the content.
+        return nil, errNoOverlap
     }
+    return ranges, nil
 }
 
 
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
 
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+    *w += countingWriter(len(p))
+    return len(p), nil
+}
 
-// name is '/'-separated, not filepath.Separator.
-func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name string, redirect bool) {
-    // const indexPage = "/index.html"
-    fmt.Printf("\nurl path: %v \n", r.URL.Path)
-    fmt.Printf("fs: %v\n", fmt.Sprintf("%v", fs))
-
-    const icn_path = "/favicon.ico"
-    // redirect .../index.html to .../
-    // can't use Redirect() because that would make the path absolute,
-    // which would be a problem running under StripPrefix
-    if r.URL.Path == icn_path && fmt.Sprintf("%v", fs) != "static" {
-        localRedirect(w, r, "/s"+icn_path)
-        return
+
+// rangesMIMESize returns the number of bytes it takes to encode the
+// provided ranges as a multipart response.
+func rangesMIMESize(ranges []httpRange, contentType string, contentSize int64) (encSize int64) {
+    var w countingWriter
+    mw := multipart.NewWriter(&w)
+    for _, ra := range ranges {
+        mw.CreatePart(ra.mimeHeader(contentType, contentSize))
+        encSize += ra.length
+    }
+    mw.Close()
+    encSize += int64(w)
+    return
+}
+
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+    for _, ra := range ranges {
+        size += ra.length
+    }
+    return
+}
+
+
+// tlsCopyBuf: TLS records are at most 16KB, but bigger reads still
+// save syscalls and encryption calls per byte.
+const tlsCopyBuf = 256 << 10
+
+var copyBufPool = sync.Pool{New: func() interface{} { b := make([]byte, tlsCopyBuf); return &b }}
+
+// writerOnly hides io.ReaderFrom so io.CopyBuffer uses our buffer.
+type writerOnly struct {
+    io.Writer
+}
+
+// ctxReader stops a copy as soon as the request is canceled.
+type ctxReader struct {
+    ctx context.Context
+    r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+    if err := cr.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return cr.r.Read(p)
+}
+
+
+// copyBody writes n bytes of src to the response.
+// plain http, unthrottled: io.CopyN hands an *os.File to the
+// connection's ReadFrom, which is sendfile(2) on linux. a client that
+// goes away fails the write and ends the copy.
+// TLS or throttled: large pooled buffers, checking the request context
+// before every read.
+func copyBody(w http.ResponseWriter, r *http.Request, src io.Reader, n int64) (int64, error) {
+    if r.TLS == nil && !downLimits.enabled() {
+        return io.CopyN(w, src, n)
     }
+    out := throttleDownload(w, r)
+    bp := copyBufPool.Get().(*[]byte)
+    defer copyBufPool.Put(bp)
+    return io.CopyBuffer(writerOnly{out}, io.LimitReader(ctxReader{r.Context(), src}, n), *bp)
+}
+
 
 
+
+// name is '/'-separated, not filepath.Separator.
+func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name string, redirect bool) {
+    const indexPage = "/index.html"
+
     f, err := fs.Open(name)
     if err != nil {
-        msg, code := toHTTPError(err)
-        http.Error(w, msg, code)
+        httpError(w, r, err)
         return
     }
     defer f.Close()
 
     d, err := f.Stat()
     if err != nil {
-        msg, code := toHTTPError(err)
-        http.Error(w, msg, code)
+        httpError(w, r, err)
         return
     }
 
-
+    hc := newHideChecker()
+    if osPath(fs, name) != "" && !hc.fetchable(name, d.IsDir()) {
+        serveError(w, r, 404, "404 page not found")
+        return
+    }
 
     if redirect {
         // redirect to canonical path: / at end of directory url
@@ -589,20 +801,25 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
         }
 
         // use contents of index.html for directory, if present
-        // index := strings.TrimSuffix(name, "/") + indexPage
-        // ff, err := fs.Open(index)
-        // if err == nil {
-        //  defer ff.Close()
-        //  dd, err := ff.Stat()
-        //  if err == nil {
-        //      name = index
-        //      d = dd
-        //      f = ff
-        //  }
-        // }
+        if indexHTML {
+            index := strings.TrimSuffix(name, "/") + indexPage
+            ff, err := fs.Open(index)
+            if err == nil {
+                dd, err := ff.Stat()
+                if err == nil && dd.Mode().IsRegular() && hc.fetchable(index, false) {
+                    defer ff.Close()
+                    name = index
+                    d = dd
+                    f = ff
+                } else {
+                    ff.Close()
+                }
+            }
+        }
     }
 
-    if checkIfModifiedSince(r, d.ModTime()) == condFalse {
+    // If-None-Match takes precedence, serveContent checks it.
+    if r.Header.Get("If-None-Match") == "" && checkIfModifiedSince(r, d.ModTime()) == condFalse {
         writeNotModified(w)
         return
     }
@@ -613,13 +830,39 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
             return
         }
         setLastModified(w, d.ModTime())
-        dirList(w, r, f)
+        dirList(w, r, f, osPath(fs, name))
         return
     }
 
     // serveContent will check modification time
     // sizeFunc := func() (int64, error) { return d.Size(), nil }
     // serveContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReadSeeker)
+    if r.URL.Query().Get("thumb") != "" {
+        serveThumb(w, r, osPath(fs, name), d)
+        return
+    }
+    if r.URL.Query().Get("view") == "1" {
+        servePreview(w, r, f, d)
+        return
+    }
+
+    // serve foo.br / foo.zst / foo.gz in place of foo when the client takes it.
+    if hasPrecompressed(fs, name) {
+        addVary(w.Header(), "Accept-Encoding")
+        if pf, pd, enc := openPrecompressed(fs, r, name, d); pf != nil {
+            defer pf.Close()
+            ctype := typeByName(name)
+            if ctype == "" {
+                ctype = "application/octet-stream"
+            }
+            w.Header().Set("Content-Type", ctype)
+            w.Header().Set("Content-Encoding", enc)
+            w.Header().Set("Etag", encodedEtag(file_etag(pd), enc))
+            serveContent(w, r, d.Name(), pd.ModTime(), pf)
+            return
+        }
+    }
+    w.Header().Set("Etag", file_etag(d))
     serveContent(w, r, d.Name(), d.ModTime(), f)
     // http.ServeContent(w, r, d.Name(), d.ModTime(), f) 
     // http.ServeFile(w, r, ".")
@@ -658,35 +901,17 @@ func GetOutboundIP() net.IP {
 }
 
 
-func check_dir_handler(w http.ResponseWriter, r *http.Request) {
-    // 403 405 403 Forbidden
-    // 405 Method Not Allowed
-    // http.ServeFile(w, r, "static/index.html")
-    q := r.URL.Query()
-    var c_dir string = q.Get("a")
-    if containsDotDot(c_dir){
-        FastResp(w, 403)
-        return
-    }
-
-    path_dir := filepath.Join(dst, c_dir)
-    if !check_is_dir(path_dir){
-        FastResp(w, 403)
-        return
-    }
-    return
-}
-
-
-
 func upload(w http.ResponseWriter, r *http.Request) {
     if r.Method == "GET" {
-        http.ServeFile(w, r, "static/index.html")
+        serveAsset(w, r, "index.html")
     } else {
+        mActiveUploads.Add(1)
+        defer mActiveUploads.Add(-1)
         q := r.URL.Query()
         var c_dir string = q.Get("a")
         if containsDotDot(c_dir){
-            http.Error(w, "Error current directory", 403)
+            mUploadFailures.Inc("bad_path")
+            serveError(w, r, 403, "Error current directory")
             return
         }
         var uuid_f string = q.Get("b")
@@ -699,48 +924,25 @@ func upload(w http.ResponseWriter, r *http.Request) {
         } 
 
         
-        path_dir := filepath.Join(dst, c_dir)
-        if !check_is_dir(path_dir){
-            // fmt.Println("bad dir")
-            // localRedirect(w, r, "/s/adfasdf")
-            // http.MaxBytesReader(w, r.Body, 8) 
-            // r.Body.Close()
-            // http.Error(w, "request too large", http.StatusExpectationFailed)
-            // ctx := r.Context()
-            // _, cancel := context.WithCancel(ctx)
-            // cancel()
-            // // http.Error(w, "eror", 500)
-            // // http.MaxBytesReader(w, r.Body, 8) 
-            // // http.Error(w, "request too large", http.StatusExpectationFailed)
-
-            r.Body = http.MaxBytesReader(w, r.Body, 1024) 
-            err := r.ParseForm()
-            if err != nil {
-                fmt.Println("max bytes reader")
-                // redirect or set error status code.
-                return
-            }
+        if !dir_in_root(c_dir){
+            mUploadFailures.Inc("bad_dir")
+            serveError(w, r, 404, "no such directory")
+            return
+        }
 
-            hj, ok := w.(http.Hijacker)
-            if !ok {
-                http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-                return
-            }
-            conn, bufrw, err := hj.Hijack()
-            if err != nil {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
+        tu, done := track_upload(w, r, path.Clean("/"+c_dir))
+        defer done()
+        // 32mb
+        throttleUpload(r)
+        if err := r.ParseMultipartForm(32 << 20); err != nil {
+            if tu.wasCanceled() {
+                serveError(w, r, 400, "upload canceled")
                 return
             }
-            // Don't forget to close the connection:
-            bufrw.WriteString("HTTP/1.1 500 Internal Server Error\n\n")
-            bufrw.Flush()
-            conn.Close()
-            // // time.Sleep(time.Duration(2)*time.Second)
+            mUploadFailures.Inc("parse")
+            serveError(w, r, 400, "bad multipart form")
             return
         }
-
-        // 32mb
-        r.ParseMultipartForm(32 << 20)
         // file, handler, err := r.FormFile("file")
         // if err != nil {
         //     fmt.Println("error: 001")
@@ -751,38 +953,98 @@ func upload(w http.ResponseWriter, r *http.Request) {
 
         // r.ParseMultipartForm(32 << 20)
         m := r.MultipartForm
+        // with extract=1 archives are unpacked, and listed in the answer.
+        extract := boolParam(r, "extract")
+        res := uploadResult{Files: []statInfo{}}
         for _, v := range m.File {
             for _, f := range v {
-                file, err := f.Open()
+                // do something with the file data
+                // fmt.Println(f.Filename)
+                // the filename may carry folders, webkitRelativePath.
+                rel, err := upload_name(f.Header, "")
                 if err != nil {
-                    http.Error(w, "eror", 500)
-                    fmt.Println("error: 003")
-                    fmt.Println(err)
+                    mUploadFailures.Inc("bad_path")
+                    serveError(w, r, 400, "bad file name")
                     return
                 }
-                defer file.Close()
-                // do something with the file data
-                // fmt.Println(f.Filename)
-                file_name_src := f.Filename
-                fmt.Println("file src name: ", file_name_src)
+                sub, file_name_src := path.Split(rel)
                 fn_a, fn_b := split_filename(file_name_src)
                 file_name_new := fn_a + uuid_suffix + fn_b
-                fmt.Println("file new name: ", file_name_new)
-                
-                fn_ok := filepath.Join(path_dir, file_name_new)
 
-                f_desc, err := os.OpenFile(fn_ok, os.O_WRONLY|os.O_CREATE, 0666) 
+                fn_ok := path.Join(c_dir, sub, file_name_new)
+                target := path.Clean("/" + fn_ok)
+                // hidden names are refused like a PUT of them, before
+                // any folder is made for them.
+                if newHideChecker().hidden(strings.TrimPrefix(target, "/"), false) {
+                    res.Skipped = append(res.Skipped, target)
+                    continue
+                }
+                if sub != "" {
+                    if err := make_dirs(path.Dir(target)); err != nil {
+                        mUploadFailures.Inc("bad_dir")
+                        log.Printf("upload: %v", err)
+                        apiFail(w, r, err)
+                        return
+                    }
+                }
+                if err := writeTarget(target, false); err != nil {
+                    mUploadFailures.Inc("bad_path")
+                    apiFail(w, r, err)
+                    return
+                }
+                tu.setFile(target)
+                // closed at the end of each file, a folder has many.
+                file, err := f.Open()
                 if err != nil {
-                    http.Error(w, "eror", 500)
-                    fmt.Println("error: 002")
-                    fmt.Println(err)
+                    mUploadFailures.Inc("open")
+                    log.Printf("upload: %v", err)
+                    serveError(w, r, 500, "can't read uploaded file")
                     return
                 }
-                defer f_desc.Close()
-                io.Copy(f_desc, file)
-                fmt.Printf("\nup: %s --> %s\n", file_name_src, fn_ok)
+                if extract && archive_format(file) != "" {
+                    if f.Size > extractMaxArchive {
+                        file.Close()
+                        extractFail(w, r, archive_too_large())
+                        return
+                    }
+                    ar, err := extract_archive(r, file, f.Size, path.Clean("/"+path.Join(c_dir, rel)), path.Clean("/"+path.Join(c_dir, sub)), true)
+                    file.Close()
+                    if err != nil {
+                        log.Printf("upload: %v", err)
+                        extractFail(w, r, err)
+                        return
+                    }
+                    res.Archives = append(res.Archives, ar)
+                    continue
+                }
+
+                f_desc, err := create_in_root(fn_ok, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666) 
+                if err != nil {
+                    file.Close()
+                    mUploadFailures.Inc("create")
+                    log.Printf("upload: %v", err)
+                    if os.IsPermission(err) {
+                        serveError(w, r, 403, "can't create file")
+                        return
+                    }
+                    serveError(w, r, 500, "can't create file")
+                    return
+                }
+                n, err := io.Copy(f_desc, file)
+                file.Close()
+                if cerr := f_desc.Close(); err == nil {
+                    err = cerr
+                }
+                if err != nil {
+                    mUploadFailures.Inc("write")
+                    log.Printf("upload %s: %v", fn_ok, err)
+                } else {
+                    res.Files = append(res.Files, stat_path(target))
+                }
+                audit(r, auditEvent{Action: auditUpload, Path: path.Join(c_dir, sub, file_name_new), Size: n, Detail: rel})
             }
         }
+        writeJSON(w, 200, res)
 
         // fmt.Fprintf(w, "%v", handler.Header)
         // f, err := os.OpenFile("/tmp/"+handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)  // 此處假設當前目錄下已存在 test 目錄
@@ -800,14 +1062,89 @@ func upload(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
+    if len(os.Args) > 1 {
+        if _, ok := clientCommands[os.Args[1]]; ok {
+            os.Exit(run_client(os.Args[1], os.Args[2:]))
+        }
+    }
+
     var dr string
     var pt uint
     var adr string
+    var accessLogPath string
+    var auditLogPath string
+    var logMaxSize int64
+    var logBackups int
+    var metricsAllowList string
+    var noCompress bool
+    var theme string
+    var staticDir string
+    var dirIndex string
+    var allowHiddenList string
+    var symlinks string
+    var apiWriteMode string
 
     flag.StringVar(&dr, "shareddir", ".", "shared Directory.")
     flag.StringVar(&adr, "address", "0.0.0.0", "listen address.")
     flag.UintVar(&pt, "port", 9898, "an listened tcp v4 port.")
+    flag.StringVar(&accessLogPath, "accesslog", "-", "access log file, \"-\" is stdout, empty disables it.")
+    flag.StringVar(&accessLogFormat, "logformat", logFormatCombined, "access log format: common, combined or json.")
+    flag.StringVar(&auditLogPath, "auditlog", "", "audit log file of uploads, url fetches, deletes, renames and share links.")
+    flag.Int64Var(&logMaxSize, "logmaxsize", 100, "rotate log files after this many MB.")
+    flag.IntVar(&logBackups, "logbackups", 5, "number of rotated log files kept.")
+    flag.StringVar(&metricsAllowList, "metricsallow", "127.0.0.1,::1", "ip or cidr list allowed to read /_/metrics and use /_/admin/.")
+    flag.StringVar(&metricsToken, "metricstoken", "", "bearer token allowed to read /_/metrics and use /_/admin/.")
+    flag.Var(rateFlag{downLimits.global}, "downrate", "global download limit, bytes per second, e.g. 512K, 10M. 0 is unlimited.")
+    flag.Var(rateFlag{downLimits.perIP}, "downrateip", "download limit per client ip.")
+    flag.Var(rateFlag{downLimits.perUser}, "downrateuser", "download limit per basic auth user name, advisory: the name is not checked.")
+    flag.Var(rateFlag{upLimits.global}, "uprate", "global upload limit, bytes per second.")
+    flag.Var(rateFlag{upLimits.perIP}, "uprateip", "upload limit per client ip.")
+    flag.Var(rateFlag{upLimits.perUser}, "uprateuser", "upload limit per basic auth user name, advisory.")
+    flag.BoolVar(&noCompress, "nocompress", false, "disable gzip, zstd and brotli compression.")
+    flag.StringVar(&theme, "theme", "", "directory with templates (listing.html) replacing the built-in ones.")
+    flag.StringVar(&staticDir, "static", "", "serve /s/ files from this directory instead of the built-in ones.")
+    flag.BoolVar(&searchIndexEnabled, "searchindex", false, "keep an in-memory index of file names for /search, updated by fsnotify.")
+    flag.StringVar(&ftsDir, "ftsindex", "", "keep a full-text index of text files in this directory, enables content search.")
+    flag.Int64Var(&ftsMaxSize, "ftsmaxsize", 10<<20, "text files larger than this many bytes are not indexed.")
+    flag.StringVar(&dirIndex, "dirindex", "readme", "directory pages: html serves index.html, readme renders README.md below the listing. comma list, or off.")
+    flag.BoolVar(&hideDotfiles, "hidedotfiles", true, "hide files and folders starting with a dot.")
+    flag.StringVar(&ignoreFileName, "ignorefile", ".transignore", "per directory file of gitignore patterns to hide, empty disables it.")
+    flag.StringVar(&allowHiddenList, "allowhidden", "", "comma list of patterns of hidden paths that can still be fetched by url.")
+    flag.StringVar(&symlinks, "symlinks", symlinkRoot, "symlinks: deny, root (only targets inside -shareddir) or all.")
+    flag.StringVar(&apiWriteMode, "apiwrite", apiWriteAdmin, "who may delete, move and share with /_/api/v1: none, admin (-metricsallow or -metricstoken) or all.")
+    flag.StringVar(&shareFile, "sharefile", "", "json file keeping share links across restarts.")
+    flag.StringVar(&thumbCacheDir, "thumbcache", default_thumb_dir(), "directory caching image thumbnails.")
+    flag.Int64Var(&extractMaxSize, "extractmaxsize", extractMaxSize, "an archive unpacked with ?extract=1 may hold at most this many bytes.")
+    flag.IntVar(&extractMaxFiles, "extractmaxfiles", extractMaxFiles, "and at most this many entries.")
+    flag.Int64Var(&extractMaxArchive, "extractmaxarchive", extractMaxArchive, "an archive uploaded with ?extract=1 may be at most this many bytes.")
+    flag.StringVar(&fetchAllowList, "fetchallow", "", "comma list of hosts (host, host:port, *.domain) /_/api/v1/fetch may download from. empty disables it.")
+    flag.Int64Var(&fetchMaxSize, "fetchmaxsize", fetchMaxSize, "a file fetched by url may be at most this many bytes.")
+    flag.DurationVar(&fetchTimeout, "fetchtimeout", fetchTimeout, "a fetch by url fails after this long.")
     flag.Parse()
+    compressEnabled = !noCompress
+
+    switch accessLogFormat {
+    case logFormatCommon, logFormatCombined, logFormatJSON:
+    default:
+        fmt.Println("!!! -logformat must be common, combined or json")
+        return
+    }
+
+    if err := parse_dir_index(dirIndex); err != nil {
+        fmt.Println("!!! -dirindex: ", err)
+        return
+    }
+
+    parse_allow_hidden(allowHiddenList)
+    parse_fetch_allow(fetchAllowList)
+    if err := parse_api_write(apiWriteMode); err != nil {
+        fmt.Println("!!! -apiwrite: ", err)
+        return
+    }
+    if err := load_shares(); err != nil {
+        fmt.Println("!!! -sharefile: ", err)
+        return
+    }
 
     fi, err := os.Stat(dr)
     if err != nil {
@@ -823,17 +1160,56 @@ func main() {
 
     dst = dr
 
-    f_static, err := os.Stat("static")
+    if err := parse_symlink_policy(symlinks); err != nil {
+        fmt.Println("!!! -symlinks: ", err)
+        return
+    }
+    if err := init_real_root(); err != nil {
+        fmt.Println("!!! -shareddir: ", err)
+        return
+    }
+
+    metricsAllow, err = parse_allow_list(metricsAllowList)
     if err != nil {
-        fmt.Println("!!!: static directory not exists")
+        fmt.Println("!!! -metricsallow: ", err)
         return
     }
 
-    mode_static := f_static.Mode()
-    if !mode_static.IsDir(){
-        fmt.Println("!!!: static directory not exists")
+    accessLog, err = open_log_writer(accessLogPath, logMaxSize, logBackups)
+    if err != nil {
+        fmt.Println("!!! access log: ", err)
+        return
+    }
+    auditLogW, err = open_log_writer(auditLogPath, logMaxSize, logBackups)
+    if err != nil {
+        fmt.Println("!!! audit log: ", err)
+        return
+    }
+
+    if err := load_assets(staticDir); err != nil {
+        fmt.Println("!!!: static files: ", err)
+        return
+    }
+    if err := load_templates(theme); err != nil {
+        fmt.Println("!!!: templates: ", err)
         return
     }
+    if err := load_error_template(); err != nil {
+        fmt.Println("!!!: error.html: ", err)
+        return
+    }
+    if searchIndexEnabled {
+        if err := searchIndex.start(); err != nil {
+            fmt.Println("!!!: search index: ", err)
+            return
+        }
+    }
+    if ftsDir != "" {
+        if err := start_fts(); err != nil {
+            fmt.Println("!!!: full-text index: ", err)
+            return
+        }
+    }
     fmt.Println("Shared Directory: ", dr)
     fmt.Println("Listening port: ", pt)
 
@@ -847,15 +1223,22 @@ func main() {
         fmt.Printf("\thttp://%s:%d/\n\n", adr, pt)
     }
 
-    http.Handle("/s/", http.StripPrefix("/s", MyFileServer(http.Dir("static"))))
-    http.HandleFunc("/d5033c97b87fec3d5fab7341a3a4c88098a1989256c52e142fe2f0ad757e25978b81cd345e8ed8a3a66d1a32409cfcbb", check_dir_handler)
+    http.HandleFunc("/s/", static_handler)
     http.HandleFunc("/upload", upload)
-    http.Handle("/", MyFileServer(http.Dir(dr)))
+    register_api(http.DefaultServeMux)
+    http.HandleFunc(sharePrefix, share_handler)
+    http.HandleFunc(reservedPrefix+"/search", search_handler)
+    http.HandleFunc(reservedPrefix+"/metrics", metrics_handler)
+    http.HandleFunc(reservedPrefix+"/admin/limits", limits_handler)
+    http.HandleFunc(reservedPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+        serveError(w, r, 404, "404 page not found")
+    })
+    http.Handle("/", MyFileServer(Dir(dr)))
     // srv := &http.Server{
     //     Addr:           pts,
     //     IdleTimeout:    8 * time.Second,
     //     MaxHeaderBytes: 1 << 20,
     // }
     // log.Fatal(srv.ListenAndServe())
-    log.Fatal(http.ListenAndServe(pts, nil))
+    log.Fatal(http.ListenAndServe(pts, logRequests(instrument(http.DefaultServeMux))))
 }
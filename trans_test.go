@@ -0,0 +1,90 @@
+package main
+
+// auth: github.com/liikii
+
+import "crypto/rand"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+
+
+const benchFileSize = 32 << 20
+
+
+// copyOld is the loop serveContent used before copyBody: 4KB reads, a
+// write and a Flush each.
+func copyOld(w http.ResponseWriter, r *http.Request, src io.Reader, n int64) (int64, error) {
+    var sent int64
+    b := make([]byte, 4096)
+    for {
+        n, err := src.Read(b)
+        w.Write(b[:n])
+        w.(http.Flusher).Flush()
+        sent += int64(n)
+        if err == io.EOF {
+            return sent, nil
+        }
+    }
+}
+
+
+func bench_file(b *testing.B) string {
+    p := filepath.Join(b.TempDir(), "blob")
+    f, err := os.Create(p)
+    if err != nil {
+        b.Fatal(err)
+    }
+    if _, err := io.CopyN(f, rand.Reader, benchFileSize); err != nil {
+        b.Fatal(err)
+    }
+    if err := f.Close(); err != nil {
+        b.Fatal(err)
+    }
+    return p
+}
+
+
+func bench_copy(b *testing.B, tls bool, copy func(http.ResponseWriter, *http.Request, io.Reader, int64) (int64, error)) {
+    p := bench_file(b)
+    h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        f, err := os.Open(p)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        defer f.Close()
+        w.Header().Set("Content-Type", "application/octet-stream")
+        copy(w, r, f, benchFileSize)
+    })
+    ts := httptest.NewUnstartedServer(h)
+    if tls {
+        ts.StartTLS()
+    } else {
+        ts.Start()
+    }
+    defer ts.Close()
+    c := ts.Client()
+    b.SetBytes(benchFileSize)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        resp, err := c.Get(ts.URL)
+        if err != nil {
+            b.Fatal(err)
+        }
+        n, err := io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        if err != nil || n != benchFileSize {
+            b.Fatalf("got %d bytes: %v", n, err)
+        }
+    }
+}
+
+
+// go test -run - -bench Copy
+func BenchmarkCopyHTTPOld(b *testing.B)  { bench_copy(b, false, copyOld) }
+func BenchmarkCopyHTTPBody(b *testing.B) { bench_copy(b, false, copyBody) }
+func BenchmarkCopyTLSOld(b *testing.B)   { bench_copy(b, true, copyOld) }
+func BenchmarkCopyTLSBody(b *testing.B)  { bench_copy(b, true, copyBody) }
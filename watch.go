@@ -0,0 +1,159 @@
+package main
+
+// recursive file system watcher of the shared directory.
+// auth: github.com/liikii
+
+import "io/fs"
+import "log"
+import "path/filepath"
+import "strings"
+import "sync"
+import "github.com/fsnotify/fsnotify"
+
+
+const (
+    evCreate = "create"
+    evWrite  = "write"
+    evRemove = "remove"
+)
+
+
+// fsEvent is a change under the share, Path is slash separated and
+// relative to the share root, e.g. "docs/a.txt".
+type fsEvent struct {
+    Op    string `json:"op"`
+    Path  string `json:"path"`
+    IsDir bool   `json:"dir"`
+}
+
+
+type treeWatcher struct {
+    root string
+    w    *fsnotify.Watcher
+    mu   sync.Mutex
+    subs map[int]func(fsEvent)
+    next int
+}
+
+
+var shareWatcher *treeWatcher
+var shareWatcherOnce sync.Once
+var shareWatcherErr error
+
+
+// watchShare starts the watcher of dst on first use.
+func watchShare() (*treeWatcher, error) {
+    shareWatcherOnce.Do(func() {
+        shareWatcher, shareWatcherErr = startTreeWatcher(dst)
+    })
+    return shareWatcher, shareWatcherErr
+}
+
+
+func startTreeWatcher(root string) (*treeWatcher, error) {
+    w, err := fsnotify.NewWatcher()
+    if err != nil {
+        return nil, err
+    }
+    tw := &treeWatcher{root: root, w: w, subs: map[int]func(fsEvent){}}
+    tw.addTree(root, false)
+    go tw.loop()
+    return tw, nil
+}
+
+
+func (tw *treeWatcher) rel(p string) string {
+    r, err := filepath.Rel(tw.root, p)
+    if err != nil {
+        return ""
+    }
+    return filepath.ToSlash(r)
+}
+
+
+// addTree watches dir and its subdirectories. a directory created
+// while we were not watching may already hold files, emit reports them.
+func (tw *treeWatcher) addTree(dir string, emit bool) {
+    filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return nil
+        }
+        if d.IsDir() {
+            if err := tw.w.Add(p); err != nil {
+                log.Printf("watch %s: %v", p, err)
+            }
+        }
+        if emit && p != dir {
+            tw.publish(fsEvent{Op: evCreate, Path: tw.rel(p), IsDir: d.IsDir()})
+        }
+        return nil
+    })
+}
+
+
+func (tw *treeWatcher) loop() {
+    for {
+        select {
+        case ev, ok := <-tw.w.Events:
+            if !ok {
+                return
+            }
+            tw.handle(ev)
+        case err, ok := <-tw.w.Errors:
+            if !ok {
+                return
+            }
+            log.Printf("watch: %v", err)
+        }
+    }
+}
+
+
+func (tw *treeWatcher) handle(ev fsnotify.Event) {
+    rel := tw.rel(ev.Name)
+    if rel == "" || rel == "." || strings.HasPrefix(rel, "../") {
+        return
+    }
+    switch {
+    case ev.Op&fsnotify.Create != 0:
+        isDir := check_is_dir(ev.Name)
+        tw.publish(fsEvent{Op: evCreate, Path: rel, IsDir: isDir})
+        if isDir {
+            tw.addTree(ev.Name, true)
+        }
+    case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+        // fsnotify drops watches of removed directories itself.
+        tw.publish(fsEvent{Op: evRemove, Path: rel})
+    case ev.Op&(fsnotify.Write|fsnotify.Chmod) != 0:
+        tw.publish(fsEvent{Op: evWrite, Path: rel, IsDir: check_is_dir(ev.Name)})
+    }
+}
+
+
+func (tw *treeWatcher) publish(ev fsEvent) {
+    tw.mu.Lock()
+    subs := make([]func(fsEvent), 0, len(tw.subs))
+    for _, fn := range tw.subs {
+        subs = append(subs, fn)
+    }
+    tw.mu.Unlock()
+    for _, fn := range subs {
+        fn(ev)
+    }
+}
+
+
+// subscribe calls fn for every event until cancel is called.
+// fn runs on the watcher goroutine and must not block.
+func (tw *treeWatcher) subscribe(fn func(fsEvent)) (cancel func()) {
+    tw.mu.Lock()
+    id := tw.next
+    tw.next++
+    tw.subs[id] = fn
+    tw.mu.Unlock()
+    return func() {
+        tw.mu.Lock()
+        delete(tw.subs, id)
+        tw.mu.Unlock()
+    }
+}